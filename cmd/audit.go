@@ -0,0 +1,142 @@
+/*
+ *
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nicksherron/bashhub-server/internal"
+	"github.com/spf13/cobra"
+)
+
+// auditCmd represents the audit command
+var (
+	apiURL        string
+	apiTokenFlag  string
+	apiUser       string
+	apiPass       string
+	auditUsername string
+	auditType     string
+	auditSince    string
+	auditUntil    string
+	auditLimit    int
+	auditJSON     bool
+	auditCmd      = &cobra.Command{
+		Use:   "audit",
+		Short: "Query the server's audit log of logins, registrations, deletions and imports",
+		Long: `Query the server's audit log. Requires an admin user (see --admins) or an
+admin scoped api key from one.
+
+Event types are login, login_failed, user_register, system_register,
+command_delete, import, apikey_create and apikey_delete.
+--since and --until take a duration before now (e.g. 24h), a date or an RFC3339 time.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			cmd.Flags().Parse(args)
+			site := strings.TrimSuffix(apiURL, "/")
+			token := apiToken(site, apiTokenFlag, apiUser, apiPass)
+
+			v := url.Values{}
+			v.Set("limit", strconv.Itoa(auditLimit))
+			if auditUsername != "" {
+				v.Set("username", auditUsername)
+			}
+			if auditType != "" {
+				v.Set("type", auditType)
+			}
+			if auditSince != "" {
+				v.Set("since", strconv.FormatInt(parseTime(auditSince), 10))
+			}
+			if auditUntil != "" {
+				v.Set("until", strconv.FormatInt(parseTime(auditUntil), 10))
+			}
+			body := apiGet(fmt.Sprintf("%v/api/v1/audit?%v", site, v.Encode()), token)
+			if auditJSON {
+				fmt.Println(string(body))
+				return
+			}
+			var events []internal.AuditEvent
+			check(json.Unmarshal(body, &events))
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "TIME\tTYPE\tUSER\tIP\tDETAIL")
+			for _, e := range events {
+				fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", time.Unix(e.Created, 0).Format(time.RFC3339),
+					e.Type, e.Username, e.IP, e.Detail)
+			}
+			w.Flush()
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(auditCmd)
+	addAPIFlags(auditCmd)
+	auditCmd.Flags().StringVar(&auditUsername, "username", "", "only show events for this username")
+	auditCmd.Flags().StringVar(&auditType, "type", "", "only show events of this type")
+	auditCmd.Flags().StringVar(&auditSince, "since", "", "only show events at or after this time")
+	auditCmd.Flags().StringVar(&auditUntil, "until", "", "only show events before this time")
+	auditCmd.Flags().IntVarP(&auditLimit, "number", "n", 100, "limit number of events")
+	auditCmd.Flags().BoolVar(&auditJSON, "json", false, "print events as json")
+}
+
+// addAPIFlags adds the flags for connecting and authenticating to a server.
+func addAPIFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&apiURL, "url", bhURL(), "bashhub-server url")
+	cmd.Flags().StringVar(&apiTokenFlag, "token", os.Getenv("BH_TOKEN"), "api key or access token (default is $BH_TOKEN)")
+	cmd.Flags().StringVar(&apiUser, "user", "", "username to log in with when --token isn't set")
+	cmd.Flags().StringVar(&apiPass, "pass", "", "password for --user (default is password prompt)")
+}
+
+func apiGet(u string, token string) []byte {
+	req, err := http.NewRequest("GET", u, nil)
+	check(err)
+	req.Header.Add("Authorization", token)
+	resp, err := http.DefaultClient.Do(req)
+	check(err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	check(err)
+	if resp.StatusCode != http.StatusOK {
+		log.Fatalf("%v response from %v: %v", resp.StatusCode, u, string(body))
+	}
+	return body
+}
+
+// parseTime parses a duration before now, a date or an RFC3339 time into unix seconds.
+func parseTime(s string) int64 {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d).Unix()
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t.Unix()
+		}
+	}
+	log.Fatalf("can't parse time %q", s)
+	return 0
+}
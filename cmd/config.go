@@ -0,0 +1,368 @@
+/*
+ *
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/BurntSushi/toml"
+	"github.com/nicksherron/bashhub-server/internal"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v2"
+)
+
+const envPrefix = "BASHHUB_SERVER_"
+
+var (
+	cfgFile string
+	// configSources records where each server setting's value came from.
+	configSources = map[string]string{}
+	// legacyEnv are env vars read before BASHHUB_SERVER_* existed. They're
+	// still honored when the BASHHUB_SERVER_* var isn't set.
+	legacyEnv = map[string]string{
+		"addr":        "BH_SERVER_URL",
+		"debug-trace": "BH_SERVER_DEBUG_TRACE",
+		"debug-cpu":   "BH_SERVER_DEBUG_CPU",
+		"debug-mem":   "BH_SERVER_DEBUG_MEM",
+	}
+	// secretFlags are masked by config print.
+	secretFlags = map[string]bool{
+		"oidc-client-secret": true,
+		"ldap-bind-password": true,
+	}
+
+	// configCmd represents the config command
+	configCmd = &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the server configuration",
+	}
+	configPrintCmd = &cobra.Command{
+		Use:   "print",
+		Short: "Print the effective server configuration and where each value came from",
+		Long: `Print the effective server configuration. Each setting is taken from, in order
+of precedence, its flag, its BASHHUB_SERVER_* env var, the config file and
+finally its default.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			file, explicit := configPath(cmd)
+			if err := loadConfig(serverFlags(cmd.Root()), file, explicit); err != nil {
+				fmt.Println("Error: \t", err)
+				os.Exit(1)
+			}
+			if _, err := os.Stat(file); err != nil {
+				file += " (not found)"
+			}
+			fmt.Println("config file:", file)
+			fmt.Println()
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tVALUE\tSOURCE")
+			for _, f := range serverFlags(cmd.Root()) {
+				value := f.Value.String()
+				if secretFlags[f.Name] && value != "" {
+					value = "********"
+				}
+				fmt.Fprintf(w, "%v\t%v\t%v\n", f.Name, value, configSources[f.Name])
+			}
+			w.Flush()
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configPrintCmd)
+}
+
+// configPath returns the config file to read and whether it was asked for
+// explicitly, in which case it has to exist.
+func configPath(cmd *cobra.Command) (string, bool) {
+	if f := cmd.Flags().Lookup("config"); f != nil && f.Changed {
+		return cfgFile, true
+	}
+	if env := os.Getenv(envPrefix + "CONFIG"); env != "" {
+		return env, true
+	}
+	return cfgFile, false
+}
+
+// serverFlags returns the flags of root that configure the server, sorted by
+// name.
+func serverFlags(root *cobra.Command) []*pflag.Flag {
+	seen := map[string]bool{"help": true, "config": true}
+	var flags []*pflag.Flag
+	visit := func(f *pflag.Flag) {
+		if !seen[f.Name] {
+			seen[f.Name] = true
+			flags = append(flags, f)
+		}
+	}
+	root.PersistentFlags().VisitAll(visit)
+	root.Flags().VisitAll(visit)
+	sort.Slice(flags, func(i, j int) bool { return flags[i].Name < flags[j].Name })
+	return flags
+}
+
+// envName returns the env var that overrides flag name.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// readConfigFile reads a yaml or toml config file of flag names to values.
+func readConfigFile(file string) (map[string]interface{}, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".toml":
+		err = toml.Unmarshal(b, &values)
+	case ".yaml", ".yml", "":
+		err = yaml.Unmarshal(b, &values)
+	default:
+		return nil, fmt.Errorf("%v: config file must be .yaml, .yml or .toml", file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", file, err)
+	}
+	return values, nil
+}
+
+// configValue converts a value decoded from a config file to flag syntax.
+func configValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i, p := range v {
+			parts[i] = fmt.Sprint(p)
+		}
+		return strings.Join(parts, ","), nil
+	case map[interface{}]interface{}, map[string]interface{}:
+		return "", errors.New("must be a value or list")
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+// loadConfig sets each flag that wasn't given on the command line from its env
+// var or else from the config file, and records where every value came from.
+// The config file is skipped when it doesn't exist unless required is set.
+func loadConfig(flags []*pflag.Flag, file string, required bool) error {
+	values := map[string]interface{}{}
+	if _, err := os.Stat(file); err == nil || required {
+		if values, err = readConfigFile(file); err != nil {
+			return err
+		}
+	}
+	known := map[string]*pflag.Flag{}
+	for _, f := range flags {
+		known[f.Name] = f
+	}
+	for k := range values {
+		if known[k] == nil {
+			return fmt.Errorf("%v: unknown setting %q", file, k)
+		}
+	}
+
+	for _, f := range flags {
+		if f.Changed {
+			configSources[f.Name] = "flag"
+			continue
+		}
+		source, value, ok := "", "", false
+		for _, env := range []string{envName(f.Name), legacyEnv[f.Name]} {
+			if env == "" {
+				continue
+			}
+			if value, ok = os.LookupEnv(env); ok {
+				source = "env " + env
+				break
+			}
+		}
+		if !ok {
+			if v, found := values[f.Name]; found {
+				s, err := configValue(v)
+				if err != nil {
+					return fmt.Errorf("%v: %v %v", file, f.Name, err)
+				}
+				source, value, ok = "config file", s, true
+			}
+		}
+		if !ok {
+			configSources[f.Name] = "default"
+			continue
+		}
+		if err := f.Value.Set(value); err != nil {
+			return fmt.Errorf("%v: invalid value %q for %v: %v", source, value, f.Name, err)
+		}
+		configSources[f.Name] = source
+	}
+	return nil
+}
+
+// validateConfig checks the server settings for mistakes that would otherwise
+// only show up once the server is running.
+func validateConfig() error {
+	var errs []string
+	fail := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, a...))
+	}
+	dirExists := func(name string, file string) {
+		if file == "" {
+			return
+		}
+		if fi, err := os.Stat(filepath.Dir(file)); err != nil || !fi.IsDir() {
+			fail("--%v: directory %v does not exist", name, filepath.Dir(file))
+		}
+	}
+	fileExists := func(name string, file string) {
+		if file == "" {
+			return
+		}
+		if _, err := os.Stat(file); err != nil {
+			fail("--%v: %v", name, err)
+		}
+	}
+
+	unix := strings.HasPrefix(addr, "unix://")
+	switch {
+	case unix:
+		dirExists("addr", strings.TrimPrefix(addr, "unix://"))
+	default:
+		hostPort := strings.TrimPrefix(strings.TrimPrefix(addr, "http://"), "https://")
+		if _, _, err := net.SplitHostPort(strings.TrimSuffix(hostPort, "/")); err != nil {
+			fail("--addr: %v", err)
+		}
+	}
+	if metricsAddr != "" {
+		if _, _, err := net.SplitHostPort(strings.TrimPrefix(metricsAddr, "http://")); err != nil {
+			fail("--metrics-addr: %v", err)
+		}
+	}
+	if strings.HasPrefix(addr, "https://") && tlsCert == "" {
+		fail("--addr: https requires --tls-cert and --tls-key")
+	}
+
+	if !strings.HasPrefix(dbPath, "postgres://") {
+		dirExists("db", dbPath)
+	}
+	dirExists("log", logFile)
+	dirExists("debug-trace", traceProfile)
+	dirExists("debug-cpu", cpuProfile)
+	dirExists("debug-mem", memProfile)
+
+	if (tlsCert == "") != (tlsKey == "") {
+		fail("--tls-cert and --tls-key must be set together")
+	}
+	fileExists("tls-cert", tlsCert)
+	fileExists("tls-key", tlsKey)
+	fileExists("tls-client-ca", tlsClientCA)
+	if tlsClientCA != "" && tlsCert == "" {
+		fail("--tls-client-ca requires --tls-cert and --tls-key")
+	}
+
+	validFormat := false
+	for _, f := range internal.LogFormats {
+		validFormat = validFormat || logFormat == f
+	}
+	if !validFormat {
+		fail("--log-format must be one of %v", strings.Join(internal.LogFormats, ", "))
+	}
+	switch logLevel {
+	case "debug", "info", "warn", "warning", "error":
+	default:
+		fail("--log-level must be one of debug, info, warn or error")
+	}
+	if logMaxSize < 1 || logBackups < 0 || logMaxAge < 0 {
+		fail("--log-max-size must be positive and --log-max-backups and --log-max-age can't be negative")
+	}
+
+	for _, limit := range [][2]string{
+		{"rate-limit-write", writeLimit},
+		{"rate-limit-write-ip", writeIPLimit},
+		{"rate-limit-search", searchLimit},
+		{"rate-limit-search-ip", searchIPLimit},
+		{"rate-limit-login", loginLimit},
+	} {
+		if _, err := internal.ParseRateLimit(limit[1]); err != nil {
+			fail("--%v: %v", limit[0], err)
+		}
+	}
+
+	for _, proxy := range proxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			fail("--trusted-proxies: %q is not an ip address or cidr", proxy)
+		}
+	}
+
+	if shutdownWait < 0 {
+		fail("--shutdown-timeout can't be negative")
+	}
+	if searchWait < 0 {
+		fail("--search-timeout can't be negative")
+	}
+
+	if oidc.Issuer != "" {
+		if u, err := url.Parse(oidc.Issuer); err != nil || u.Host == "" {
+			fail("--oidc-issuer: %q is not a url", oidc.Issuer)
+		}
+		if oidc.ClientID == "" {
+			fail("--oidc-issuer requires --oidc-client-id")
+		}
+		if oidc.RedirectURL == "" && unix {
+			fail("--oidc-redirect-url is required when listening on a unix socket")
+		}
+	}
+
+	if ldap.URL != "" {
+		if u, err := url.Parse(ldap.URL); err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") {
+			fail("--ldap-url: %q is not an ldap:// or ldaps:// url", ldap.URL)
+		}
+		if ldap.BaseDN == "" {
+			fail("--ldap-url requires --ldap-base-dn")
+		}
+		if !strings.Contains(ldap.UserFilter, "%s") {
+			fail("--ldap-user-filter must contain %%s")
+		}
+		if ldap.BindDN == "" && ldap.BindPassword != "" {
+			fail("--ldap-bind-password requires --ldap-bind-dn")
+		}
+	} else {
+		if len(ldap.BreakGlass) != 0 {
+			fail("--ldap-break-glass requires --ldap-url")
+		}
+		if ldap.LinkLocal {
+			fail("--ldap-link-local requires --ldap-url")
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n\t%v", strings.Join(errs, "\n\t"))
+	}
+	return nil
+}
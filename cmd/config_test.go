@@ -0,0 +1,74 @@
+/*
+ *
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/spf13/pflag"
+)
+
+func TestLoadConfig(t *testing.T) {
+	for _, file := range []struct{ name, body, unknown string }{
+		{"config.yaml", "addr: http://config:1\nadmins: [alice, bob]\nworkers: 3\ndb: config.db\n", "bogus: 1\n"},
+		{"config.toml", "addr = \"http://config:1\"\nadmins = [\"alice\", \"bob\"]\nworkers = 3\ndb = \"config.db\"\n", "bogus = 1\n"},
+	} {
+		path := filepath.Join(testDir, file.name)
+		check(ioutil.WriteFile(path, []byte(file.body), 0600))
+
+		fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+		addr := fs.String("addr", "http://default:1", "")
+		admins := fs.StringSlice("admins", nil, "")
+		workers := fs.Int("workers", 1, "")
+		db := fs.String("db", "default.db", "")
+		log := fs.String("log", "", "")
+		check(fs.Parse([]string{"--db", "flag.db"}))
+		os.Setenv("BASHHUB_SERVER_WORKERS", "5")
+
+		var flags []*pflag.Flag
+		fs.VisitAll(func(f *pflag.Flag) { flags = append(flags, f) })
+		err := loadConfig(flags, path, true)
+		os.Unsetenv("BASHHUB_SERVER_WORKERS")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, *addr, "http://config:1")
+		assert.Equal(t, *admins, []string{"alice", "bob"})
+		assert.Equal(t, *workers, 5)
+		assert.Equal(t, *db, "flag.db")
+		assert.Equal(t, *log, "")
+		assert.Equal(t, configSources["addr"], "config file")
+		assert.Equal(t, configSources["workers"], "env BASHHUB_SERVER_WORKERS")
+		assert.Equal(t, configSources["db"], "flag")
+		assert.Equal(t, configSources["log"], "default")
+
+		check(ioutil.WriteFile(path, []byte(file.unknown), 0600))
+		if err := loadConfig(flags, path, true); err == nil {
+			t.Errorf("%v: expected error for unknown setting", file.name)
+		}
+	}
+	if err := loadConfig(nil, filepath.Join(testDir, "missing.yaml"), false); err != nil {
+		t.Error(err)
+	}
+}
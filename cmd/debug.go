@@ -0,0 +1,112 @@
+/*
+ *
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// debugCmd represents the debug command
+var (
+	profileType     string
+	profileDuration time.Duration
+	profileOutput   string
+	// profileTypes are the profiles the server can record, and whether they're
+	// recorded over --duration rather than being a snapshot.
+	profileTypes = map[string]bool{
+		"cpu":          true,
+		"trace":        true,
+		"heap":         false,
+		"allocs":       false,
+		"goroutine":    false,
+		"block":        false,
+		"mutex":        false,
+		"threadcreate": false,
+	}
+
+	debugCmd = &cobra.Command{
+		Use:   "debug",
+		Short: "Debug a running server",
+	}
+	debugProfileCmd = &cobra.Command{
+		Use:   "profile",
+		Short: "Record a profile or execution trace from a running server",
+		Long: `Record a profile or execution trace from a running server and save it to a
+file for go tool pprof, or go tool trace for --type trace. Requires an admin
+user (see --admins) or an admin scoped api key from one.
+
+cpu profiles and traces are recorded for --duration, the other types are a
+snapshot taken when the command runs.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			cmd.Flags().Parse(args)
+			timed, ok := profileTypes[profileType]
+			if !ok {
+				log.Fatalf("unknown profile type %q", profileType)
+			}
+			site := strings.TrimSuffix(apiURL, "/")
+			token := apiToken(site, apiTokenFlag, apiUser, apiPass)
+
+			u := fmt.Sprintf("%v/debug/pprof/%v", site, profileType)
+			if profileType == "cpu" {
+				u = site + "/debug/pprof/profile"
+			}
+			if timed {
+				seconds := int(math.Ceil(profileDuration.Seconds()))
+				if seconds < 1 {
+					seconds = 1
+				}
+				u += "?" + url.Values{"seconds": {strconv.Itoa(seconds)}}.Encode()
+				fmt.Printf("recording %v for %vs\n", profileType, seconds)
+			}
+			body := apiGet(u, token)
+
+			out := profileOutput
+			if out == "" {
+				out = fmt.Sprintf("%v-%v.pprof", profileType, time.Now().Format("20060102-150405"))
+				if profileType == "trace" {
+					out = strings.TrimSuffix(out, ".pprof") + ".out"
+				}
+			}
+			check(ioutil.WriteFile(out, body, 0644))
+			tool := "pprof"
+			if profileType == "trace" {
+				tool = "trace"
+			}
+			fmt.Printf("wrote %v, view it with: go tool %v %v\n", out, tool, out)
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(debugCmd)
+	debugCmd.AddCommand(debugProfileCmd)
+	addAPIFlags(debugProfileCmd)
+	debugProfileCmd.Flags().StringVar(&profileType, "type", "cpu", "cpu, trace, heap, allocs, goroutine, block, mutex or threadcreate")
+	debugProfileCmd.Flags().DurationVar(&profileDuration, "duration", 30*time.Second, "how long to record cpu profiles and traces for")
+	debugProfileCmd.Flags().StringVarP(&profileOutput, "output", "o", "", "file to write the profile to (default is <type>-<time>.pprof)")
+}
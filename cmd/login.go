@@ -0,0 +1,152 @@
+/*
+ *
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+type deviceAuth struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// loginCmd represents the login command
+var (
+	loginURL string
+	loginMac string
+	loginCmd = &cobra.Command{
+		Use:   "login",
+		Short: "Log in through the server's identity provider and print an access token",
+		Long: `Log in through the server's OpenID Connect identity provider using the device flow.
+Open the printed url on any device with a browser, enter the code and the
+access token is printed to stdout once the login is approved.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			cmd.Flags().Parse(args)
+			fmt.Println(deviceLogin(strings.TrimSuffix(loginURL, "/"), loginMac))
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(loginCmd)
+	loginCmd.Flags().StringVar(&loginURL, "url", bhURL(), "bashhub-server url")
+	loginCmd.Flags().StringVar(&loginMac, "mac", "", "mac of a registered system to include in the token")
+}
+
+func bhURL() string {
+	if u := os.Getenv("BH_URL"); u != "" {
+		return u
+	}
+	return "http://localhost:8080"
+}
+
+func postJSON(u string, payload interface{}, v interface{}) (int, error) {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := http.Post(u, "application/json", bytes.NewReader(payloadBytes))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(v)
+}
+
+func deviceLogin(site string, mac string) string {
+	var auth deviceAuth
+	code, err := postJSON(site+"/api/v1/oidc/device", map[string]string{}, &auth)
+	check(err)
+	if code != http.StatusOK {
+		log.Fatalf("device login is not available on %v, got status code %v", site, code)
+	}
+
+	if auth.VerificationURIComplete != "" {
+		fmt.Fprintf(os.Stderr, "Open %v to log in\n", auth.VerificationURIComplete)
+	} else {
+		fmt.Fprintf(os.Stderr, "Open %v and enter code %v to log in\n", auth.VerificationURI, auth.UserCode)
+	}
+
+	interval := time.Duration(auth.Interval) * time.Second
+	if interval == 0 {
+		interval = 5 * time.Second
+	}
+	deadline := time.Now().Add(time.Duration(auth.ExpiresIn) * time.Second)
+	for auth.ExpiresIn == 0 || time.Now().Before(deadline) {
+		time.Sleep(interval)
+		j := make(map[string]string)
+		code, err := postJSON(site+"/api/v1/oidc/device/token", map[string]string{
+			"device_code": auth.DeviceCode,
+			"mac":         mac,
+		}, &j)
+		check(err)
+		switch {
+		case code == http.StatusOK:
+			return fmt.Sprintf("Bearer %v", j["accessToken"])
+		case j["error"] == "authorization_pending":
+		case j["error"] == "slow_down":
+			interval += 5 * time.Second
+		default:
+			log.Fatalf("login failed for %v: %v", site, j["error"])
+		}
+	}
+	log.Fatal("device code expired before login was approved")
+	return ""
+}
+
+// apiToken returns the bearer token for commands that call the api. An api key
+// or token given with --token is used as is, otherwise user logs in with pass.
+func apiToken(site string, token string, user string, pass string) string {
+	if token != "" {
+		if !strings.HasPrefix(token, "Bearer ") {
+			token = "Bearer " + token
+		}
+		return token
+	}
+	if user == "" {
+		log.Fatal("--token or --user is required")
+	}
+	if pass == "" {
+		pass = credentials(user)
+	}
+	j := make(map[string]interface{})
+	code, err := postJSON(site+"/api/v1/login", map[string]string{
+		"username": user,
+		"password": pass,
+	}, &j)
+	check(err)
+	if code != http.StatusOK {
+		log.Fatalf("login failed for %v: %v", site, j["message"])
+	}
+	return fmt.Sprintf("Bearer %v", j["accessToken"])
+}
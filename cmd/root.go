@@ -22,13 +22,12 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"os/signal"
 	"path/filepath"
 	"runtime"
 	"runtime/pprof"
 	"runtime/trace"
 	"strings"
-	"syscall"
+	"time"
 
 	"github.com/fatih/color"
 	"github.com/nicksherron/bashhub-server/internal"
@@ -37,22 +36,87 @@ import (
 
 // rootCmd represents the base command when called without any subcommands
 var (
-	logFile      string
-	dbPath       string
-	addr         string
-	registration bool
-	traceProfile = os.Getenv("BH_SERVER_DEBUG_TRACE")
-	cpuProfile   = os.Getenv("BH_SERVER_DEBUG_CPU")
-	memProfile   = os.Getenv("BH_SERVER_DEBUG_MEM")
-	rootCmd      = &cobra.Command{
+	logFile       string
+	dbPath        string
+	addr          string
+	registration  bool
+	oidc          internal.OIDCConfig
+	ldap          internal.LDAPConfig
+	admins        []string
+	tlsCert       string
+	tlsKey        string
+	tlsClientCA   string
+	shutdownWait  time.Duration
+	metricsAddr   string
+	logFormat     string
+	logLevel      string
+	logMaxSize    int
+	logBackups    int
+	logMaxAge     int
+	slowQuery     time.Duration
+	searchWait    time.Duration
+	writeLimit    string
+	writeIPLimit  string
+	searchLimit   string
+	searchIPLimit string
+	loginLimit    string
+	proxies       []string
+	traceProfile  string
+	cpuProfile    string
+	memProfile    string
+	rootCmd       = &cobra.Command{
 		Run: func(cmd *cobra.Command, args []string) {
 			cmd.Flags().Parse(args)
+			file, explicit := configPath(cmd)
+			if err := loadConfig(serverFlags(cmd), file, explicit); err != nil {
+				fmt.Println("Error: \t", err)
+				os.Exit(1)
+			}
+			if err := validateConfig(); err != nil {
+				fmt.Println("Error: \t", err)
+				os.Exit(1)
+			}
 			checkBhEnv()
 			startupMessage()
+			if oidc.Issuer != "" && oidc.RedirectURL == "" {
+				oidc.RedirectURL = strings.TrimSuffix(addr, "/") + "/api/v1/oidc/callback"
+			}
+			srv, err := internal.NewServer(internal.Options{
+				DB:              dbPath,
+				Log:             logFile,
+				Addr:            addr,
+				Registration:    registration,
+				OIDC:            oidc,
+				LDAP:            ldap,
+				Admins:          admins,
+				TLSCert:         tlsCert,
+				TLSKey:          tlsKey,
+				TLSClientCA:     tlsClientCA,
+				ShutdownTimeout: shutdownWait,
+				MetricsAddr:     metricsAddr,
+				LogFormat:       logFormat,
+				LogLevel:        logLevel,
+				LogMaxSize:      logMaxSize,
+				LogMaxBackups:   logBackups,
+				LogMaxAge:       logMaxAge,
+				SlowQuery:       slowQuery,
+				SearchTimeout:   searchWait,
+				RateLimits:      rateLimits(),
+				TrustedProxies:  proxies,
+				Version:         Version,
+				GitCommit:       GitCommit,
+				BuildDate:       BuildDate,
+			})
+			if err != nil {
+				log.Fatal(err)
+			}
 			if cpuProfile != "" || memProfile != "" || traceProfile != "" {
-				profileInit()
+				srv.RegisterOnShutdown(profileInit())
+			}
+			if err := srv.Run(); err != nil {
+				fmt.Println("Error: \t", err)
+				os.Exit(1)
 			}
-			internal.Run(dbPath, logFile, addr, registration)
 		},
 	}
 )
@@ -67,11 +131,48 @@ func Execute() {
 
 func init() {
 	cobra.OnInitialize()
+	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", filepath.Join(appDir(), "config.yaml"), "yaml or toml config file. Settings are flag names, each also overridable with a BASHHUB_SERVER_* env var")
 	rootCmd.PersistentFlags().StringVar(&logFile, "log", "", `Set filepath for HTTP log. "" logs to stderr`)
+	rootCmd.Flags().StringVar(&logFormat, "log-format", "text", "Log format, one of "+strings.Join(internal.LogFormats, ", "))
+	rootCmd.Flags().StringVar(&logLevel, "log-level", "info", "Log level, one of debug, info, warn or error. debug logs every db query")
+	rootCmd.Flags().IntVar(&logMaxSize, "log-max-size", 100, "Megabytes a --log file can grow to before it's rotated")
+	rootCmd.Flags().IntVar(&logBackups, "log-max-backups", 5, "Number of rotated --log files to keep, 0 keeps all")
+	rootCmd.Flags().IntVar(&logMaxAge, "log-max-age", 0, "Days to keep rotated --log files, 0 keeps them regardless of age")
+	rootCmd.Flags().DurationVar(&slowQuery, "log-slow-query", 500*time.Millisecond, "Log db queries that take longer than this")
 	rootCmd.PersistentFlags().StringVar(&dbPath, "db", sqlitePath(), "db location (sqlite or postgres)")
-	rootCmd.PersistentFlags().StringVarP(&addr, "addr", "a", listenAddr(), "Ip and port to listen and serve on")
+	rootCmd.PersistentFlags().StringVarP(&addr, "addr", "a", listenAddr(), "Ip and port, or unix:///path/to.sock, to listen and serve on")
 	rootCmd.PersistentFlags().BoolVarP(&registration, "registration", "r", true, "Allow user registration")
-
+	rootCmd.Flags().StringVar(&tlsCert, "tls-cert", "", "TLS certificate file. Serves https, reloaded on SIGHUP or when the file changes")
+	rootCmd.Flags().StringVar(&tlsKey, "tls-key", "", "TLS private key file")
+	rootCmd.Flags().StringVar(&tlsClientCA, "tls-client-ca", "", "CA file for verifying client certificates. A client certificate's common name logs in as that username")
+	rootCmd.Flags().DurationVar(&shutdownWait, "shutdown-timeout", 30*time.Second, "How long to wait for in-flight requests to finish on SIGINT or SIGTERM")
+	rootCmd.Flags().StringVar(&metricsAddr, "metrics-addr", "", `Ip and port to serve prometheus /metrics on without authentication. "" serves it on --addr for admins only`)
+	rootCmd.Flags().DurationVar(&searchWait, "search-timeout", 10*time.Second, "Cancel searches that take longer than this, 0 doesn't time out")
+	rootCmd.Flags().StringVar(&writeLimit, "rate-limit-write", "0", `Requests per user to add, delete or import commands and register systems, as <requests>/<period>. "0" is unlimited`)
+	rootCmd.Flags().StringVar(&writeIPLimit, "rate-limit-write-ip", "0", `Requests per client ip to add, delete or import commands and register systems, as <requests>/<period>. "0" is unlimited`)
+	rootCmd.Flags().StringVar(&searchLimit, "rate-limit-search", "20/s", "Searches per user, as <requests>/<period>")
+	rootCmd.Flags().StringVar(&searchIPLimit, "rate-limit-search-ip", "100/s", "Searches per client ip, as <requests>/<period>")
+	rootCmd.Flags().StringVar(&loginLimit, "rate-limit-login", "30/m", "Logins and registrations per client ip, as <requests>/<period>")
+	rootCmd.Flags().StringSliceVar(&proxies, "trusted-proxies", nil, "Addresses or cidrs of reverse proxies whose X-Forwarded-For header gives the client ip. Other requests use their remote address")
+	rootCmd.Flags().StringSliceVar(&admins, "admins", nil, "Usernames allowed to use admin endpoints such as the audit log")
+	rootCmd.Flags().StringVar(&oidc.Issuer, "oidc-issuer", "", "OpenID Connect issuer url. Enables login through an external identity provider")
+	rootCmd.Flags().StringVar(&oidc.ClientID, "oidc-client-id", "", "OpenID Connect client id")
+	rootCmd.Flags().StringVar(&oidc.ClientSecret, "oidc-client-secret", "", "OpenID Connect client secret")
+	rootCmd.Flags().StringVar(&oidc.RedirectURL, "oidc-redirect-url", "", `OpenID Connect redirect url (default is --addr + "/api/v1/oidc/callback")`)
+	rootCmd.Flags().StringVar(&ldap.URL, "ldap-url", "", "LDAP url, e.g. ldaps://ldap.example.com. Enables directory authentication, only --ldap-break-glass accounts keep local logins")
+	rootCmd.Flags().StringVar(&ldap.BindDN, "ldap-bind-dn", "", "DN to bind as when searching for users (default is anonymous)")
+	rootCmd.Flags().StringVar(&ldap.BindPassword, "ldap-bind-password", "", "password for --ldap-bind-dn")
+	rootCmd.Flags().StringVar(&ldap.BaseDN, "ldap-base-dn", "", "LDAP search base for users and groups")
+	rootCmd.Flags().StringVar(&ldap.UserFilter, "ldap-user-filter", "(uid=%s)", "LDAP filter for finding a user, %s is replaced with the username")
+	rootCmd.Flags().StringVar(&ldap.GroupFilter, "ldap-group-filter", "", "LDAP filter users must match a group with to log in, %s is replaced with the user DN")
+	rootCmd.Flags().StringSliceVar(&ldap.BreakGlass, "ldap-break-glass", nil, "Local accounts that can log in with their local password when they're not in the LDAP directory or it's unreachable")
+	rootCmd.Flags().BoolVar(&ldap.LinkLocal, "ldap-link-local", false, "Let LDAP users log in to existing local accounts with the same username instead of refusing them")
+	rootCmd.Flags().StringVar(&traceProfile, "debug-trace", "", "write an execution trace to this file on shutdown")
+	rootCmd.Flags().StringVar(&cpuProfile, "debug-cpu", "", "write a CPU profile to this file on shutdown")
+	rootCmd.Flags().StringVar(&memProfile, "debug-mem", "", "write a heap profile to this file on shutdown")
+	for _, name := range []string{"debug-trace", "debug-cpu", "debug-mem"} {
+		_ = rootCmd.Flags().MarkHidden(name)
+	}
 }
 
 // StartupMessage prints startup banner
@@ -90,18 +191,18 @@ func startupMessage() {
                                                                                   
 `, Version, addr, registration)
 	color.HiGreen(banner)
-	log.Printf("\nListening and serving HTTP on %v\n", addr)
+	scheme := "HTTP"
+	if tlsCert != "" || strings.HasPrefix(addr, "https://") {
+		scheme = "HTTPS"
+	}
+	log.Printf("\nListening and serving %v on %v\n", scheme, addr)
+	if metricsAddr != "" {
+		log.Printf("Serving metrics on %v/metrics\n", metricsAddr)
+	}
 }
 
 func listenAddr() string {
-	var a string
-	if os.Getenv("BH_SERVER_URL") != "" {
-		a = os.Getenv("BH_SERVER_URL")
-		return a
-	}
-	a = "http://0.0.0.0:8080"
-	return a
-
+	return "http://0.0.0.0:8080"
 }
 
 func sqlitePath() string {
@@ -135,50 +236,67 @@ export BH_URL=%v to your .bashrc or .zshrc`, addr)
 	}
 }
 
-func profileInit() {
+// rateLimits parses the --rate-limit-* flags, which validateConfig has checked.
+func rateLimits() internal.RateLimits {
+	var limits internal.RateLimits
+	limits.Write, _ = internal.ParseRateLimit(writeLimit)
+	limits.WriteIP, _ = internal.ParseRateLimit(writeIPLimit)
+	limits.Search, _ = internal.ParseRateLimit(searchLimit)
+	limits.SearchIP, _ = internal.ParseRateLimit(searchIPLimit)
+	limits.Login, _ = internal.ParseRateLimit(loginLimit)
+	return limits
+}
 
-	go func() {
-		defer os.Exit(1)
-		if traceProfile != "" {
-			f, err := os.Create(traceProfile)
-			if err != nil {
-				log.Fatal("could not create trace profile: ", err)
-			}
-			defer f.Close()
-			if err := trace.Start(f); err != nil {
-				log.Fatal("could not start trace profile: ", err)
-			}
-			defer trace.Stop()
+// profileInit starts the profiles set by the --debug-* flags and
+// returns a func that stops and writes them.
+func profileInit() func() {
+	var stops []func()
+	if traceProfile != "" {
+		f, err := os.Create(traceProfile)
+		if err != nil {
+			log.Fatal("could not create trace profile: ", err)
 		}
+		if err := trace.Start(f); err != nil {
+			log.Fatal("could not start trace profile: ", err)
+		}
+		stops = append(stops, func() {
+			trace.Stop()
+			f.Close()
+		})
+	}
 
-		if cpuProfile != "" {
-			f, err := os.Create(cpuProfile)
-			if err != nil {
-				log.Fatal("could not create CPU profile: ", err)
-			}
-			defer f.Close()
-			if err := pprof.StartCPUProfile(f); err != nil {
-				log.Fatal("could not start CPU profile: ", err)
-			}
-			defer pprof.StopCPUProfile()
+	if cpuProfile != "" {
+		f, err := os.Create(cpuProfile)
+		if err != nil {
+			log.Fatal("could not create CPU profile: ", err)
 		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			log.Fatal("could not start CPU profile: ", err)
+		}
+		stops = append(stops, func() {
+			pprof.StopCPUProfile()
+			f.Close()
+		})
+	}
 
-		defer func() {
-			if memProfile != "" {
-				mf, err := os.Create(memProfile)
-				if err != nil {
-					log.Fatal("could not create memory profile: ", err)
-				}
-				defer mf.Close()
-				runtime.GC() // get up-to-date statistics
-				if err := pprof.WriteHeapProfile(mf); err != nil {
-					log.Fatal("could not write memory profile: ", err)
-				}
+	if memProfile != "" {
+		stops = append(stops, func() {
+			mf, err := os.Create(memProfile)
+			if err != nil {
+				log.Println("could not create memory profile: ", err)
+				return
+			}
+			defer mf.Close()
+			runtime.GC() // get up-to-date statistics
+			if err := pprof.WriteHeapProfile(mf); err != nil {
+				log.Println("could not write memory profile: ", err)
 			}
-		}()
+		})
+	}
 
-		sigs := make(chan os.Signal, 1)
-		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-		<-sigs
-	}()
+	return func() {
+		for _, stop := range stops {
+			stop()
+		}
+	}
 }
@@ -26,6 +26,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -41,6 +42,10 @@ type cList struct {
 	UUID    string `json:"uuid"`
 	Command string `json:"command"`
 	Created int64  `json:"created"`
+	// Username is only set by servers that return the full row from a
+	// verbose search, which is kept in Data to import without a lookup.
+	Username string          `json:"username"`
+	Data     json.RawMessage `json:"-"`
 }
 
 type commandsList []cList
@@ -171,6 +176,10 @@ func run() {
 		}
 	}()
 	for _, v := range cmdList {
+		if v.Username != "" {
+			pipe <- v.Data
+			continue
+		}
 		v.Retries = 0
 		queue <- v
 	}
@@ -320,7 +329,7 @@ func getToken(site string, user string, pass string) string {
 }
 
 func getCommandList() commandsList {
-	u := strings.TrimSpace(srcURL) + fmt.Sprintf("/api/v1/command/search?unique=%v&limit=%v", unique, limit)
+	u := strings.TrimSpace(srcURL) + fmt.Sprintf("/api/v1/command/search?unique=%v&limit=%v&verbose=true", unique, limit)
 	req, err := http.NewRequest("GET", u, nil)
 	if err != nil {
 		log.Fatal(err)
@@ -343,11 +352,18 @@ func getCommandList() commandsList {
 	if err != nil {
 		log.Fatal(err)
 	}
-	var result commandsList
-	err = json.Unmarshal(body, &result)
+	var rows []json.RawMessage
+	err = json.Unmarshal(body, &rows)
 	if err != nil {
 		log.Fatal(err)
 	}
+	result := make(commandsList, len(rows))
+	for i, row := range rows {
+		if err := json.Unmarshal(row, &result[i]); err != nil {
+			log.Fatal(err)
+		}
+		result[i].Data = row
+	}
 
 	return result
 }
@@ -420,21 +436,35 @@ func srcSend(data []byte, retries int) {
 		wgSrc.Done()
 	}()
 
-	body := bytes.NewReader(data)
-
 	u := dstURL + "/api/v1/import"
-	req, err := http.NewRequest("POST", u, body)
-	if err != nil {
-		log.SetOutput(os.Stderr)
-		log.Fatal(err)
+	for {
+		req, err := http.NewRequest("POST", u, bytes.NewReader(data))
+		if err != nil {
+			log.SetOutput(os.Stderr)
+			log.Fatal(err)
+		}
+
+		req.Header.Add("Authorization", dstToken)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			log.SetOutput(os.Stderr)
+			log.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusTooManyRequests {
+			return
+		}
+		// over the destination's write rate limit
+		time.Sleep(retryAfter(resp))
 	}
+}
 
-	req.Header.Add("Authorization", dstToken)
-	_, err = http.DefaultClient.Do(req)
-	if err != nil {
-		log.SetOutput(os.Stderr)
-		log.Fatal(err)
+// retryAfter returns how long a 429 response asks to wait before retrying.
+func retryAfter(resp *http.Response) time.Duration {
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
 	}
+	return time.Second
 }
 
 func check(err error) {
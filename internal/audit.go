@@ -0,0 +1,92 @@
+/*
+ *
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/appleboy/gin-jwt/v2"
+	"github.com/gin-gonic/gin"
+)
+
+// AuditEvent is a security relevant action recorded in the append-only audit_events table.
+type AuditEvent struct {
+	ID       uint   `json:"id" gorm:"primary_key"`
+	Created  int64  `json:"created"`
+	Type     string `json:"type"`
+	Username string `json:"username"`
+	UserId   uint   `json:"userId"`
+	IP       string `json:"ip" gorm:"column:ip"`
+	Detail   string `json:"detail"`
+}
+
+// AuditFilter selects audit events. Zero values match everything.
+type AuditFilter struct {
+	Username string
+	Type     string
+	Since    int64
+	Until    int64
+	Limit    int
+}
+
+const (
+	auditLogin          = "login"
+	auditLoginFailed    = "login_failed"
+	auditUserRegister   = "user_register"
+	auditSystemRegister = "system_register"
+	auditCommandDelete  = "command_delete"
+	auditImport         = "import"
+	auditAPIKeyCreate   = "apikey_create"
+	auditAPIKeyDelete   = "apikey_delete"
+)
+
+// audit records an event for the request in c. Failing to write the event is
+// logged but doesn't fail the request.
+func audit(c *gin.Context, event AuditEvent) {
+	if event.Username == "" {
+		claims := jwt.ExtractClaims(c)
+		event.Username, _ = claims["username"].(string)
+		if id, ok := claims["user_id"].(float64); ok {
+			event.UserId = uint(id)
+		}
+	}
+	loginObserve(event)
+	// ClientIP only believes forwarding headers from Options.TrustedProxies.
+	event.IP = c.ClientIP()
+	event.Created = time.Now().Unix()
+	if err := event.auditInsert(c.Request.Context()); err != nil {
+		ctxLog(c.Request.Context()).WithError(err).WithField("type", event.Type).Error("audit event not recorded")
+	}
+}
+
+// requireAdmin only lets the server admins through.
+func requireAdmin(admins []string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := jwt.ExtractClaims(c)
+		for _, admin := range admins {
+			if claims["username"] == admin {
+				c.Next()
+				return
+			}
+		}
+		respondError(c, http.StatusForbidden, errCodeForbidden, errors.New("admin access required"))
+	}
+}
@@ -19,10 +19,13 @@
 package internal
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"fmt"
 	"log"
-	"regexp"
 	"strings"
 	"time"
 
@@ -38,17 +41,76 @@ import (
 )
 
 var (
-	db              *sql.DB
+	db              *sqlDB
 	connectionLimit int
 )
 
+// fillBatchSize is how many uuids commandFill looks up per query, under
+// sqlite's default limit of 999 parameters.
+const fillBatchSize = 500
+
+// sqlDB times and logs every query. Queries made with a request's context are
+// logged with that request's id. Statements are retried while the db is busy.
+type sqlDB struct {
+	*sql.DB
+}
+
+func (d sqlDB) ExecContext(ctx context.Context, query string, args ...interface{}) (res sql.Result, err error) {
+	err = retryBusy(ctx, func() error {
+		start := time.Now()
+		res, err = d.DB.ExecContext(ctx, query, args...)
+		queryDone(ctx, query, time.Since(start), err)
+		return err
+	})
+	return res, err
+}
+
+func (d sqlDB) QueryContext(ctx context.Context, query string, args ...interface{}) (rows *sql.Rows, err error) {
+	err = retryBusy(ctx, func() error {
+		start := time.Now()
+		rows, err = d.DB.QueryContext(ctx, query, args...)
+		queryDone(ctx, query, time.Since(start), err)
+		return err
+	})
+	return rows, err
+}
+
+// QueryRowContext can't see the row's error, which is only returned by Scan, so
+// only its latency is logged and it isn't retried. Single row reads don't
+// conflict with writers on postgres or on sqlite in WAL mode, and otherwise
+// wait out sqlite's busy timeout.
+func (d sqlDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	start := time.Now()
+	row := d.DB.QueryRowContext(ctx, query, args...)
+	queryDone(ctx, query, time.Since(start), nil)
+	return row
+}
+
+func (d sqlDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return d.ExecContext(context.Background(), query, args...)
+}
+
+func (d sqlDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return d.QueryContext(context.Background(), query, args...)
+}
+
+func (d sqlDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return d.QueryRowContext(context.Background(), query, args...)
+}
+
+func queryDone(ctx context.Context, query string, d time.Duration, err error) {
+	queryObserve(query, d)
+	queryLog(ctx, query, d, err)
+}
+
 func dbInit(dbPath string) {
 	var gormdb *gorm.DB
+	var sqldb *sql.DB
 	var err error
 	if strings.HasPrefix(dbPath, "postgres://") {
 		// postgres
 
-		db, err = sql.Open("postgres", dbPath)
+		sqldb, err = sql.Open("postgres", dbPath)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -57,6 +119,7 @@ func dbInit(dbPath string) {
 		if err != nil {
 			log.Fatal(err)
 		}
+		db = &sqlDB{sqldb}
 		connectionLimit = 50
 	} else {
 		// sqlite
@@ -64,24 +127,19 @@ func dbInit(dbPath string) {
 		if err != nil {
 			log.Fatal(err)
 		}
-		// sqlite regex function
-		regex := func(re, s string) (bool, error) {
-			b, e := regexp.MatchString(re, s)
-			return b, e
-		}
-
 		sql.Register("sqlite3_with_regex",
 			&sqlite3.SQLiteDriver{
 				ConnectHook: func(conn *sqlite3.SQLiteConn) error {
-					return conn.RegisterFunc("regexp", regex, true)
+					return conn.RegisterFunc("regexp", sqliteRegexp, true)
 				},
 			})
 
-		dbPath = fmt.Sprintf("file:%v?cache=shared&mode=rwc&_loc=auto", dbPath)
-		db, err = sql.Open("sqlite3_with_regex", dbPath)
+		dbPath = fmt.Sprintf("file:%v?cache=shared&mode=rwc&_loc=auto&_busy_timeout=5000", dbPath)
+		sqldb, err = sql.Open("sqlite3_with_regex", dbPath)
 		if err != nil {
 			log.Fatal(err)
 		}
+		db = &sqlDB{sqldb}
 
 		_, err = db.Exec("PRAGMA journal_mode=WAL;")
 		if err != nil {
@@ -95,20 +153,175 @@ func dbInit(dbPath string) {
 	gormdb.AutoMigrate(&Command{})
 	gormdb.AutoMigrate(&System{})
 	gormdb.AutoMigrate(&Config{})
+	gormdb.AutoMigrate(&APIKey{})
+	gormdb.AutoMigrate(&AuditEvent{})
+	gormdb.AutoMigrate(&Session{})
+	gormdb.AutoMigrate(&Migration{})
 
 	//TODO: ensure these are the most efficient indexes
 	gormdb.Model(&User{}).AddUniqueIndex("idx_user", "username")
+	gormdb.Model(&User{}).AddUniqueIndex("idx_user_oidc_subject", "oidc_subject")
 	gormdb.Model(&System{}).AddIndex("idx_mac", "mac")
 	gormdb.Model(&Command{}).AddIndex("idx_user_command_created", "user_id, created, command")
 	gormdb.Model(&Command{}).AddIndex("idx_user_uuid", "user_id, uuid")
+	gormdb.Model(&Command{}).AddIndex("idx_user_duration", "user_id, duration")
 	gormdb.Model(&Config{}).AddUniqueIndex("idx_config_id", "id")
 	gormdb.Model(&Command{}).AddUniqueIndex("idx_uuid", "uuid")
+	gormdb.Model(&APIKey{}).AddIndex("idx_api_key_user", "user_id")
+	gormdb.Model(&AuditEvent{}).AddIndex("idx_audit_created", "created")
+	gormdb.Model(&AuditEvent{}).AddIndex("idx_audit_username_created", "username, created")
+	gormdb.Model(&Session{}).AddUniqueIndex("idx_session", "user_id, system_name, process_id, process_start_time")
+	gormdb.Model(&Session{}).AddIndex("idx_session_user_last", "user_id, last_command")
 
 	// Just need gorm for migration and index creation.
 	gormdb.Close()
+
+	auditAppendOnly()
+	migrateOnce("sessions_backfill", sessionsBackfill)
+	ftsInit()
+	fuzzyInit()
+}
+
+// auditAppendOnly adds triggers that reject updates and deletes on audit_events.
+func auditAppendOnly() {
+	var err error
+	if connectionLimit != 1 {
+		_, err = db.Exec(`
+		CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+		BEGIN
+			RAISE EXCEPTION 'audit_events is append-only';
+		END;
+		$$ LANGUAGE plpgsql;
+		DROP TRIGGER IF EXISTS audit_events_append_only ON audit_events;
+		CREATE TRIGGER audit_events_append_only BEFORE UPDATE OR DELETE ON audit_events
+			FOR EACH ROW EXECUTE PROCEDURE audit_events_append_only();`)
+	} else {
+		_, err = db.Exec(`
+		CREATE TRIGGER IF NOT EXISTS audit_events_no_update BEFORE UPDATE ON audit_events
+		BEGIN SELECT RAISE(ABORT, 'audit_events is append-only'); END;
+		CREATE TRIGGER IF NOT EXISTS audit_events_no_delete BEFORE DELETE ON audit_events
+		BEGIN SELECT RAISE(ABORT, 'audit_events is append-only'); END;`)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Migration records a one-off data migration that has been run.
+type Migration struct {
+	Name    string `gorm:"primary_key"`
+	Created int64
+}
+
+// migrateOnce runs migrate unless it has been run before, in the same
+// transaction that records it was, so one that fails or is interrupted is run
+// again on the next start.
+func migrateOnce(name string, migrate func(ctx context.Context, tx *sql.Tx) error) {
+	ctx := context.Background()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer tx.Rollback()
+	var done bool
+	err = tx.QueryRowContext(ctx, `SELECT count(*) > 0 FROM migrations WHERE "name" = $1`, name).Scan(&done)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if done {
+		return
+	}
+	if err := migrate(ctx, tx); err != nil {
+		log.Fatalf("%v migration: %v", name, err)
+	}
+	_, err = txExec(ctx, tx, `INSERT INTO migrations ("name", "created") VALUES ($1, $2) ON CONFLICT DO NOTHING`,
+		name, time.Now().Unix())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// sessionsBackfill adds the sessions of commands saved before there was a
+// sessions table. Sessions that already exist are replaced with the ones
+// worked out from their commands.
+func sessionsBackfill(ctx context.Context, tx *sql.Tx) error {
+	_, err := txExec(ctx, tx, `
+	INSERT INTO sessions ("user_id", "system_name", "process_id", "process_start_time",
+		"first_command", "last_command", "first_path", "last_path", "total_commands")
+	SELECT "user_id", "system_name", "process_id", "process_start_time", min("created"), max("created"),
+		(SELECT "path" FROM commands f
+			WHERE f."user_id" = c."user_id" AND f."system_name" = c."system_name"
+			AND f."process_id" = c."process_id" AND f."process_start_time" = c."process_start_time"
+		ORDER BY f."created" LIMIT 1),
+		(SELECT "path" FROM commands l
+			WHERE l."user_id" = c."user_id" AND l."system_name" = c."system_name"
+			AND l."process_id" = c."process_id" AND l."process_start_time" = c."process_start_time"
+		ORDER BY l."created" DESC LIMIT 1),
+		count(*)
+	FROM commands c
+	WHERE "process_start_time" > 0 AND "system_name" IS NOT NULL AND "path" IS NOT NULL
+	GROUP BY "user_id", "system_name", "process_id", "process_start_time"
+	ON CONFLICT ("user_id", "system_name", "process_id", "process_start_time") DO UPDATE SET
+		"first_command" = excluded."first_command",
+		"last_command" = excluded."last_command",
+		"first_path" = excluded."first_path",
+		"last_path" = excluded."last_path",
+		"total_commands" = excluded."total_commands"`)
+	return err
+}
+
+// dbClose closes the db, checkpointing the sqlite write-ahead log first so the
+// db file is complete on its own.
+func dbClose() error {
+	if connectionLimit == 1 {
+		if _, err := db.Exec("PRAGMA wal_checkpoint(TRUNCATE);"); err != nil {
+			return err
+		}
+	}
+	return db.Close()
+}
+
+// dbTables are the tables created by dbInit's migrations.
+var dbTables = []string{"users", "commands", "systems", "configs", "api_keys", "audit_events", "sessions", "migrations"}
+
+// dbDialect is the name of the db in use.
+func dbDialect() string {
+	if connectionLimit != 1 {
+		return "postgres"
+	}
+	return "sqlite"
+}
+
+// dbMigrated returns an error naming the first of dbTables that can't be read.
+func dbMigrated(ctx context.Context) error {
+	for _, table := range dbTables {
+		rows, err := db.QueryContext(ctx, fmt.Sprintf(`SELECT 1 FROM %v LIMIT 1`, table))
+		if err != nil {
+			return fmt.Errorf("%v: %w", table, err)
+		}
+		rows.Close()
+	}
+	return nil
+}
+
+// dbRowCounts counts the rows in each of dbTables.
+func dbRowCounts(ctx context.Context) (map[string]int64, error) {
+	counts := make(map[string]int64, len(dbTables))
+	for _, table := range dbTables {
+		var n int64
+		err := db.QueryRowContext(ctx, fmt.Sprintf(`SELECT count(*) FROM %v`, table)).Scan(&n)
+		if err != nil {
+			return nil, err
+		}
+		counts[table] = n
+	}
+	return counts, nil
 }
 
-func (c Config) getSecret() string {
+func (c Config) getSecret() (string, error) {
 	var err error
 	if connectionLimit != 1 {
 		_, err = db.Exec(`INSERT INTO configs ("id","created", "secret") 
@@ -121,16 +334,16 @@ func (c Config) getSecret() string {
 						ON conflict do nothing;`)
 	}
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
 	err = db.QueryRow(`SELECT "secret" from configs where "id" = 1 `).Scan(&c.Secret)
-	return c.Secret
+	return c.Secret, err
 }
 
 func hashAndSalt(password string) string {
 	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
 	if err != nil {
-		log.Println(err)
+		logger.WithError(err).Error("hashing password")
 	}
 	return string(hash)
 }
@@ -139,307 +352,220 @@ func comparePasswords(hashedPwd string, plainPwd string) bool {
 	byteHash := []byte(hashedPwd)
 	err := bcrypt.CompareHashAndPassword(byteHash, []byte(plainPwd))
 	if err != nil {
-		log.Println(err)
+		if err != bcrypt.ErrMismatchedHashAndPassword {
+			logger.WithError(err).Error("comparing password")
+		}
 		return false
 	}
 	return true
 }
 
-func (user User) userExists() bool {
+// userExists reports whether user's username and password match a local account.
+func (user User) userExists(ctx context.Context) (bool, error) {
 	var password string
-	err := db.QueryRow("SELECT password FROM users WHERE username = $1",
+	err := db.QueryRowContext(ctx, "SELECT password FROM users WHERE username = $1",
 		user.Username).Scan(&password)
 	if err != nil && err != sql.ErrNoRows {
-		log.Fatalf("error checking if row exists %v", err)
+		return false, err
 	}
 	if password != "" {
-		return comparePasswords(password, user.Password)
+		return comparePasswords(password, user.Password), nil
 	}
-	return false
+	return false, nil
 }
 
-func (user User) userGetID() uint {
+// userGetID returns the id of user, 0 if there is no such user.
+func (user User) userGetID(ctx context.Context) (uint, error) {
 	var id uint
-	err := db.QueryRow(`SELECT "id" 
+	err := db.QueryRowContext(ctx, `SELECT "id" 
 							FROM users 
 							WHERE "username"  = $1`,
 		user.Username).Scan(&id)
 	if err != nil && err != sql.ErrNoRows {
-		log.Fatalf("error checking if row exists %v", err)
+		return 0, err
 	}
-	return id
+	return id, nil
 }
 
-func (user User) userGetSystemName() string {
+func (user User) userGetSystemName(ctx context.Context) (string, error) {
 	var systemName string
-	err := db.QueryRow(`SELECT name 
+	err := db.QueryRowContext(ctx, `SELECT name 
 							FROM systems 
 							WHERE user_id in (select id from users where username = $1)
 							AND mac = $2`,
 		user.Username, user.Mac).Scan(&systemName)
 	if err != nil && err != sql.ErrNoRows {
-		log.Fatalf("error checking if row exists %v", err)
+		return "", err
 	}
-	return systemName
+	return systemName, nil
 }
 
-func (user User) usernameExists() bool {
+func (user User) usernameExists(ctx context.Context) (bool, error) {
 	var exists bool
-	err := db.QueryRow(`SELECT exists (select id FROM users WHERE "username" = $1)`,
+	err := db.QueryRowContext(ctx, `SELECT exists (select id FROM users WHERE "username" = $1)`,
 		user.Username).Scan(&exists)
 	if err != nil && err != sql.ErrNoRows {
-		log.Fatalf("error checking if row exists %v", err)
+		return false, err
 	}
-	return exists
+	return exists, nil
 }
 
-func (user User) emailExists() bool {
+func (user User) emailExists(ctx context.Context) (bool, error) {
 	var exists bool
-	err := db.QueryRow(`SELECT exists (select id FROM users WHERE "email" = $1)`,
+	err := db.QueryRowContext(ctx, `SELECT exists (select id FROM users WHERE "email" = $1)`,
 		user.Email).Scan(&exists)
 	if err != nil && err != sql.ErrNoRows {
-		log.Fatalf("error checking if row exists %v", err)
+		return false, err
 	}
-	return exists
+	return exists, nil
 }
 
-func (user User) userCreate() int64 {
+func (user User) userCreate(ctx context.Context) (int64, error) {
 	user.Password = hashAndSalt(user.Password)
-	res, err := db.Exec(`INSERT INTO users("registration_code", "username","password","email")
+	res, err := db.ExecContext(ctx, `INSERT INTO users("registration_code", "username","password","email")
  							 VALUES ($1,$2,$3,$4) ON CONFLICT(username) do nothing`, user.RegistrationCode,
 		user.Username, user.Password, user.Email)
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
-	inserted, err := res.RowsAffected()
-	if err != nil {
-		log.Fatal(err)
-	}
-	return inserted
+	return res.RowsAffected()
 }
 
-func (cmd Command) commandInsert() int64 {
+// oidcUserLink returns the user linked to an identity provider subject,
+// creating a passwordless user on the subject's first login. Usernames and
+// emails from the provider can change hands, so existing accounts are never
+// linked by them; a taken username is a conflict.
+func oidcUserLink(ctx context.Context, claims oidcClaims) (User, error) {
+	var user User
+	err := db.QueryRowContext(ctx, `SELECT "id", "username" FROM users WHERE "oidc_subject" = $1`,
+		claims.Subject).Scan(&user.ID, &user.Username)
+	if err != sql.ErrNoRows {
+		return user, err
+	}
 
-	res, err := db.Exec(`
-	INSERT INTO commands("process_id","process_start_time","exit_status","uuid","command", "created", "path", "user_id", "system_name")
- 	VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9) ON CONFLICT do nothing`,
-		cmd.ProcessId, cmd.ProcessStartTime, cmd.ExitStatus, cmd.Uuid, cmd.Command, cmd.Created, cmd.Path, cmd.User.ID, cmd.SystemName)
+	_, err = db.ExecContext(ctx, `INSERT INTO users("username", "password", "email", "oidc_subject")
+						 VALUES ($1, '', $2, $3) ON CONFLICT DO NOTHING`,
+		claims.username(), claims.Email, claims.Subject)
 	if err != nil {
-		log.Fatal(err)
+		return User{}, err
 	}
-	inserted, err := res.RowsAffected()
+	err = db.QueryRowContext(ctx, `SELECT "id", "username" FROM users WHERE "oidc_subject" = $1`,
+		claims.Subject).Scan(&user.ID, &user.Username)
+	if err == sql.ErrNoRows {
+		return User{}, errOIDCUserConflict
+	}
+	return user, err
+}
+
+// ldapUserLink returns the id of a directory user, creating a passwordless user
+// on their first login. A local account with the same username is only used
+// when link is set, and is marked as the directory user's from then on, with
+// its password left as it was. Otherwise the login is refused with
+// errLDAPUserConflict.
+func ldapUserLink(ctx context.Context, username string, email string, link bool) (uint, error) {
+	_, err := db.ExecContext(ctx, `INSERT INTO users("username", "password", "email", "ldap_linked")
+						 VALUES ($1, '', $2, true) ON CONFLICT(username) do nothing`, username, email)
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
-	return inserted
+	var id uint
+	var linked bool
+	err = db.QueryRowContext(ctx, `SELECT "id", "ldap_linked" FROM users WHERE "username" = $1`, username).Scan(&id, &linked)
+	if err != nil || linked {
+		return id, err
+	}
+	if !link {
+		return 0, errLDAPUserConflict
+	}
+	_, err = db.ExecContext(ctx, `UPDATE users SET "ldap_linked" = true WHERE "id" = $1`, id)
+	return id, err
 }
 
-func (cmd Command) commandGet() ([]Query, error) {
-	var (
-		results []Query
-		query   string
-	)
-	if cmd.Unique || cmd.Query != "" {
-		//postgres
-		if connectionLimit != 1 {
-			if cmd.SystemName != "" && cmd.Path != "" && cmd.Query != "" && cmd.Unique {
-				query = fmt.Sprintf(`
-				SELECT * FROM  ( 
-			        SELECT DISTINCT ON ("command") command, "uuid", "created"
-			        FROM commands
-			       	WHERE  "user_id" = '%v'  
-			       	AND "path" = '%v' 
-			       	AND "system_name" = '%v'								
-			       	AND "command" ~ '%v'
-			        ) c
-			    ORDER BY "created" DESC limit '%v';`, cmd.User.ID, cmd.Path, cmd.SystemName, cmd.Query, cmd.Limit)
-
-			} else if cmd.Path != "" && cmd.Query != "" && cmd.Unique {
-				query = fmt.Sprintf(`
-				SELECT * FROM  ( 
-					SELECT DISTINCT ON ("command") command, "uuid", "created"
-					FROM commands
-					WHERE  "user_id" = '%v'  
-					AND "path" = '%v' 
-					AND "command" ~ '%v'
-					) c
-				ORDER BY "created" DESC limit '%v';`, cmd.User.ID, cmd.Path, cmd.Query, cmd.Limit)
-
-			} else if cmd.SystemName != "" && cmd.Query != "" {
-				query = fmt.Sprintf(`
-				SELECT "command", "uuid", "created"
-					FROM commands
-					WHERE  "user_id" = '%v'  
-					AND "system_name" = '%v' 
-					AND "command" ~ '%v'
-				ORDER BY "created" DESC limit '%v';`, cmd.User.ID, cmd.SystemName, cmd.Query, cmd.Limit)
-
-			} else if cmd.Path != "" && cmd.Query != "" {
-				query = fmt.Sprintf(`
-				SELECT "command", "uuid", "created"
-					FROM commands
-					WHERE  "user_id" = '%v'  
-					AND "path" = '%v' 
-					AND "command" ~ '%v'
-				ORDER BY "created" DESC limit '%v';`, cmd.User.ID, cmd.Path, cmd.Query, cmd.Limit)
-
-			} else if cmd.SystemName != "" && cmd.Unique {
-				query = fmt.Sprintf(`
-				SELECT * FROM  ( 
-					SELECT DISTINCT ON ("command") command, "uuid", "created"
-					FROM commands
-					WHERE  "user_id" = '%v'  
-					AND "system_name" = '%v' 
-					) c
-				ORDER BY "created" DESC limit '%v';`, cmd.User.ID, cmd.SystemName, cmd.Limit)
-
-			} else if cmd.Path != "" && cmd.Unique {
-				query = fmt.Sprintf(`
-				SELECT * FROM  ( 
-					SELECT DISTINCT ON ("command") command, "uuid", "created"
-					FROM commands
-					WHERE  "user_id" = '%v'  
-					AND "path" = '%v'
-					) c
-				ORDER BY "created" DESC limit '%v';`, cmd.User.ID, cmd.Path, cmd.Limit)
-
-			} else if cmd.Query != "" && cmd.Unique {
-				query = fmt.Sprintf(`
-				SELECT * FROM  ( 
-					SELECT DISTINCT ON ("command") command, "uuid", "created"
-					FROM commands
-					WHERE  "user_id" = '%v'  
-					AND "command" ~ '%v'
-					) c
-				ORDER BY "created" DESC limit '%v';`, cmd.User.ID, cmd.Query, cmd.Limit)
-
-			} else if cmd.Query != "" {
-				query = fmt.Sprintf(`
-				SELECT "command", "uuid", "created"
-					FROM commands
-					WHERE  "user_id" = '%v'  
-					AND "command" ~ '%v'
-				ORDER BY "created" DESC limit '%v';`, cmd.User.ID, cmd.Query, cmd.Limit)
-
-			} else {
-				// unique
-				query = fmt.Sprintf(`
-				SELECT * FROM  ( 
-					SELECT DISTINCT ON ("command") command, "uuid", "created"
-					FROM commands
-					WHERE  "user_id" = '%v'   
-					) c
-				ORDER BY "created" DESC limit '%v';`, cmd.User.ID, cmd.Limit)
-			}
-		} else {
-			// sqlite
-			if cmd.SystemName != "" && cmd.Path != "" && cmd.Query != "" && cmd.Unique {
-				// Have to use fmt.Sprintf to build queries where sqlite regexp function is used because of single quotes. Haven't found any other work around.
-				query = fmt.Sprintf(`
-				SELECT "command",  "uuid", "created" FROM commands
-                    WHERE "user_id" =  '%v'  
-					AND "path" = '%v'
-					AND "system_name" = '%v'
-					AND "command" regexp '%v'
-				GROUP BY "command" ORDER  BY  "created" DESC limit '%v'`, cmd.User.ID, cmd.Path, cmd.SystemName, cmd.Query, cmd.Limit)
-
-			} else if cmd.SystemName != "" && cmd.Query != "" && cmd.Unique {
-				query = fmt.Sprintf(`
-				SELECT "command",  "uuid", "created" FROM commands
-                    WHERE "user_id" =  '%v'  
-					AND "system_name" = '%v' 
-					AND "command" regexp '%v'
-				GROUP BY "command" ORDER  BY  "created" DESC limit '%v'`, cmd.User.ID, cmd.SystemName, cmd.Query, cmd.Limit)
-
-			} else if cmd.Path != "" && cmd.Query != "" && cmd.Unique {
-				query = fmt.Sprintf(`
-				SELECT "command",  "uuid", "created" FROM commands
-                    WHERE "user_id" =  '%v'  
-					AND "path" = '%v' 
-					AND "command" regexp '%v'
-				GROUP BY "command" ORDER  BY  "created" DESC limit '%v'`, cmd.User.ID, cmd.Path, cmd.Query, cmd.Limit)
-
-			} else if cmd.SystemName != "" && cmd.Query != "" {
-				query = fmt.Sprintf(`
-				SELECT "command",  "uuid", "created" FROM commands
-					WHERE "user_id" =  '%v'   
-					AND "system_name" = '%v' 
-					AND "command" regexp '%v'
-				ORDER  BY  "created" DESC limit '%v'`, cmd.User.ID, cmd.SystemName, cmd.Query, cmd.Limit)
-
-			} else if cmd.Path != "" && cmd.Query != "" {
-				query = fmt.Sprintf(`
-				SELECT "command",  "uuid", "created" FROM commands
-					WHERE "user_id" =  '%v'   
-					AND "path" = '%v' 
-					AND "command" regexp '%v'
-				ORDER  BY  "created" DESC limit '%v'`, cmd.User.ID, cmd.Path, cmd.Query, cmd.Limit)
-
-			} else if cmd.SystemName != "" && cmd.Unique {
-				query = fmt.Sprintf(`
-				SELECT "command",  "uuid", "created" FROM commands
-					WHERE  "user_id" = '%v'   
-					AND "system_name" = '%v'
-				GROUP BY "command" ORDER  BY  "created" DESC limit '%v'`, cmd.User.ID, cmd.SystemName, cmd.Limit)
-
-			} else if cmd.Path != "" && cmd.Unique {
-				query = fmt.Sprintf(`
-				SELECT "command",  "uuid", "created" FROM commands
-					WHERE  "user_id" = '%v'   
-					AND "path" = '%v'
-				GROUP BY "command" ORDER  BY  "created" DESC limit '%v'`, cmd.User.ID, cmd.Path, cmd.Limit)
-
-			} else if cmd.Query != "" && cmd.Unique {
-				query = fmt.Sprintf(`
-				SELECT "command", "uuid", "created" FROM commands
-					WHERE "user_id" =  '%v'   
-					AND "command" regexp '%v'  
-				GROUP BY "command" ORDER  BY "created" DESC limit '%v'`, cmd.User.ID, cmd.Query, cmd.Limit)
-
-			} else if cmd.Query != "" {
-				query = fmt.Sprintf(`
-				SELECT "command",  "uuid", "created" FROM commands
-					WHERE "user_id" =  '%v'   
-					AND "command" regexp'%v'
-				ORDER  BY  "created" DESC limit '%v'`, cmd.User.ID, cmd.Query, cmd.Limit)
-
-			} else {
-				// unique
-				query = fmt.Sprintf(`
-				SELECT "command", "uuid", "created"
-					FROM commands
-					WHERE  "user_id" = '%v'  
-				GROUP BY "command"  ORDER BY "created" DESC limit '%v';`, cmd.User.ID, cmd.Limit)
-			}
+func (cmd Command) commandInsert(ctx context.Context) (int64, error) {
+	var inserted int64
+	err := retryBusy(ctx, func() error {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
 		}
-	} else {
-		if cmd.Path != "" {
-			query = fmt.Sprintf(`
-			SELECT "command",  "uuid", "created" FROM commands
-				WHERE  "user_id" = '%v' 
-				AND "path" = '%v'  
-			ORDER  BY  "created" DESC limit '%v'`, cmd.User.ID, cmd.Path, cmd.Limit)
-		} else if cmd.SystemName != "" {
-			query = fmt.Sprintf(`SELECT "command",  "uuid", "created" FROM commands
-			WHERE  "user_id" = '%v'
-			AND "system_name" = '%v'
-			ORDER  BY  "created" DESC limit '%v'`, cmd.User.ID, cmd.SystemName, cmd.Limit)
-
-		} else {
-			query = fmt.Sprintf(`
-			SELECT "command",  "uuid", "created" FROM commands
-				WHERE  "user_id" = '%v'  
-			ORDER  BY  "created" DESC limit '%v'`, cmd.User.ID, cmd.Limit)
+		defer tx.Rollback()
+		res, err := txExec(ctx, tx, `
+		INSERT INTO commands("process_id","process_start_time","exit_status","uuid","command", "created", "path", "user_id", "system_name",
+			"start_time", "end_time", "duration")
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12) ON CONFLICT do nothing`,
+			cmd.ProcessId, cmd.ProcessStartTime, cmd.ExitStatus, cmd.Uuid, cmd.Command, cmd.Created, cmd.Path, cmd.User.ID, cmd.SystemName,
+			nullIfZero(cmd.StartTime), nullIfZero(cmd.EndTime), nullIfZero(cmd.Duration))
+		if err != nil {
+			return err
 		}
+		if inserted, err = res.RowsAffected(); err != nil {
+			return err
+		}
+		if inserted > 0 && cmd.ProcessStartTime != 0 {
+			if err := cmd.sessionRecord(ctx, tx); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+	return inserted, err
+}
 
+// nullIfZero stores optional numbers that weren't given as null.
+func nullIfZero(v int64) interface{} {
+	if v == 0 {
+		return nil
 	}
+	return v
+}
+
+// txExec runs a statement in tx, timed and logged like those run by sqlDB.
+func txExec(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) (sql.Result, error) {
+	start := time.Now()
+	res, err := tx.ExecContext(ctx, query, args...)
+	queryDone(ctx, query, time.Since(start), err)
+	return res, err
+}
 
-	rows, err := db.Query(query)
+// sessionRecord adds cmd to its session, starting the session if it's the
+// first of its commands.
+func (cmd Command) sessionRecord(ctx context.Context, tx *sql.Tx) error {
+	_, err := txExec(ctx, tx, `
+	INSERT INTO sessions ("user_id", "system_name", "process_id", "process_start_time",
+		"first_command", "last_command", "first_path", "last_path", "total_commands")
+	VALUES ($1, $2, $3, $4, $5, $5, $6, $6, 1)
+	ON CONFLICT ("user_id", "system_name", "process_id", "process_start_time") DO UPDATE SET
+		"first_command" = CASE WHEN excluded."first_command" < sessions."first_command"
+			THEN excluded."first_command" ELSE sessions."first_command" END,
+		"first_path" = CASE WHEN excluded."first_command" < sessions."first_command"
+			THEN excluded."first_path" ELSE sessions."first_path" END,
+		"last_command" = CASE WHEN excluded."last_command" >= sessions."last_command"
+			THEN excluded."last_command" ELSE sessions."last_command" END,
+		"last_path" = CASE WHEN excluded."last_command" >= sessions."last_command"
+			THEN excluded."last_path" ELSE sessions."last_path" END,
+		"total_commands" = sessions."total_commands" + 1`,
+		cmd.User.ID, cmd.SystemName, cmd.ProcessId, cmd.ProcessStartTime, cmd.Created, cmd.Path)
+	return err
+}
 
+func (cmd Command) commandGet(ctx context.Context) ([]Query, error) {
+	if cmd.Unique {
+		return cmd.commandGetUnique(ctx)
+	}
+	args, filters := cmd.searchFilters(nil)
+	args = append(args, cmd.Limit)
+	query := fmt.Sprintf(`
+	SELECT "command", "uuid", "created"
+		FROM commands
+		WHERE %v
+	ORDER BY "created" DESC LIMIT $%v`, filters, len(args))
+
+	rows, err := db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return []Query{}, err
 	}
 	defer rows.Close()
+	var results []Query
 	for rows.Next() {
 		var result Query
 		err = rows.Scan(&result.Command, &result.Uuid, &result.Created)
@@ -448,76 +574,258 @@ func (cmd Command) commandGet() ([]Query, error) {
 		}
 		results = append(results, result)
 	}
-	return results, nil
+	return results, rows.Err()
+
+}
+
+// searchFilters adds cmd's user, filters and regex query to args and returns
+// the conditions that use them. sqlite numbers parameters in the order they
+// appear, so the conditions have to follow any that use args already.
+func (cmd Command) searchFilters(args []interface{}) ([]interface{}, string) {
+	args = append(args, cmd.User.ID)
+	filters := fmt.Sprintf(`"user_id" = $%v`, len(args))
+	filter := func(condition string, value interface{}) {
+		args = append(args, value)
+		filters += fmt.Sprintf(condition, len(args))
+	}
+	if cmd.Path != "" {
+		filter(` AND "path" = $%v`, cmd.Path)
+	}
+	if cmd.SystemName != "" {
+		filter(` AND "system_name" = $%v`, cmd.SystemName)
+	}
+	if cmd.MinDuration > 0 {
+		filter(` AND "duration" >= $%v`, cmd.MinDuration)
+	}
+	if cmd.Query != "" {
+		match := "REGEXP"
+		if connectionLimit != 1 {
+			match = "~"
+		}
+		filter(` AND "command" `+match+` $%v`, cmd.Query)
+	}
+	return args, filters
+}
+
+// uniqueRuns wraps matches, a query for commands with at least the "command",
+// "uuid", "created", "path" and "system_name" columns, so each command is
+// listed once. Each one is its latest matching run, ties broken by uuid, with
+// how many runs matched as "runs" and when the first was as "first_seen".
+// It's used by unique searches in every mode so they agree.
+func uniqueRuns(matches string) string {
+	return fmt.Sprintf(`
+	SELECT * FROM (
+		SELECT m.*,
+			count(*) OVER "runs" AS "runs",
+			min("created") OVER "runs" AS "first_seen",
+			row_number() OVER ("runs" ORDER BY "created" DESC, "uuid" DESC) AS "n"
+		FROM (%v) m
+		WINDOW "runs" AS (PARTITION BY "command")
+	) r
+	WHERE "n" = 1`, matches)
+}
+
+// uniqueColumns are the columns scanned by scanUnique.
+const uniqueColumns = `"command", "uuid", "created", "path", "system_name", "runs", "first_seen"`
+
+// scanUnique scans the uniqueColumns of each row.
+func scanUnique(rows *sql.Rows) ([]Query, error) {
+	defer rows.Close()
+	var results []Query
+	for rows.Next() {
+		var result Query
+		if err := rows.Scan(&result.Command, &result.Uuid, &result.Created, &result.Path, &result.SystemName,
+			&result.Count, &result.FirstSeen); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+// commandGetUnique lists cmd's user's commands once each, newest first. Each
+// one is its latest run, ties broken by uuid, with how many times and
+// when it was first run.
+func (cmd Command) commandGetUnique(ctx context.Context) ([]Query, error) {
+	args, filters := cmd.searchFilters(nil)
+	args = append(args, cmd.Limit)
+	query := fmt.Sprintf(`
+	SELECT %v FROM (%v) u
+	ORDER BY "created" DESC, "uuid" DESC LIMIT $%v`,
+		uniqueColumns, uniqueRuns(`SELECT * FROM commands WHERE `+filters), len(args))
 
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanUnique(rows)
 }
 
-func (cmd Command) commandGetUUID() (Query, error) {
+func (cmd Command) commandGetUUID(ctx context.Context) (Query, error) {
 	var result Query
-	err := db.QueryRow(`
-	SELECT "command","path", "created" , "uuid", "exit_status", "system_name", "process_id" 
+	err := db.QueryRowContext(ctx, `
+	SELECT "command","path", "created" , "uuid", "exit_status", "system_name", "process_id",
+		coalesce("start_time", 0), coalesce("end_time", 0), coalesce("duration", 0)
 		FROM commands
 		WHERE "uuid" = $1 
 	AND "user_id" = $2`, cmd.Uuid, cmd.User.ID).Scan(&result.Command, &result.Path, &result.Created, &result.Uuid,
-		&result.ExitStatus, &result.SystemName, &result.SessionID)
+		&result.ExitStatus, &result.SystemName, &result.SessionID, &result.StartTime, &result.EndTime, &result.Duration)
 	if err != nil {
 		return Query{}, err
 	}
 	return result, nil
 }
 
-func (cmd Command) commandDelete() int64 {
-	res, err := db.Exec(`
-	DELETE FROM commands WHERE "user_id" = $1 AND "uuid" = $2 `, cmd.User.ID, cmd.Uuid)
-	if err != nil {
-		log.Fatal(err)
+// commandFill sets the rest of the columns of cmd's user's search results,
+// looking them up by uuid a batch at a time.
+func (cmd Command) commandFill(ctx context.Context, results []Query) error {
+	byUUID := make(map[string][]*Query, len(results))
+	var uuids []string
+	for i := range results {
+		u := results[i].Uuid
+		if _, ok := byUUID[u]; !ok {
+			uuids = append(uuids, u)
+		}
+		byUUID[u] = append(byUUID[u], &results[i])
 	}
-	inserted, err := res.RowsAffected()
-	if err != nil {
-		log.Fatal(err)
+	for len(uuids) > 0 {
+		batch := uuids
+		if len(batch) > fillBatchSize {
+			batch = batch[:fillBatchSize]
+		}
+		uuids = uuids[len(batch):]
+
+		args := []interface{}{cmd.User.ID}
+		params := make([]string, len(batch))
+		for i, u := range batch {
+			args = append(args, u)
+			params[i] = fmt.Sprintf("$%v", len(args))
+		}
+		rows, err := db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT "uuid", "path", "exit_status", "system_name", "process_id",
+			coalesce("start_time", 0), coalesce("end_time", 0), coalesce("duration", 0)
+			FROM commands
+			WHERE "user_id" = $1
+		AND "uuid" IN (%v)`, strings.Join(params, ", ")), args...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var row Query
+			if err := rows.Scan(&row.Uuid, &row.Path, &row.ExitStatus, &row.SystemName, &row.SessionID,
+				&row.StartTime, &row.EndTime, &row.Duration); err != nil {
+				rows.Close()
+				return err
+			}
+			for _, result := range byUUID[row.Uuid] {
+				result.Path, result.ExitStatus = row.Path, row.ExitStatus
+				result.SystemName, result.SessionID = row.SystemName, row.SessionID
+				result.StartTime, result.EndTime, result.Duration = row.StartTime, row.EndTime, row.Duration
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return err
+		}
 	}
-	return inserted
+	return nil
+}
 
+func (cmd Command) commandDelete(ctx context.Context) (int64, error) {
+	var deleted int64
+	err := retryBusy(ctx, func() error {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		var (
+			systemName sql.NullString
+			pid        sql.NullInt64
+			start      sql.NullInt64
+		)
+		err = tx.QueryRowContext(ctx, `
+		SELECT "system_name", "process_id", "process_start_time" FROM commands
+			WHERE "user_id" = $1 AND "uuid" = $2`, cmd.User.ID, cmd.Uuid).Scan(&systemName, &pid, &start)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		res, err := txExec(ctx, tx, `
+		DELETE FROM commands WHERE "user_id" = $1 AND "uuid" = $2 `, cmd.User.ID, cmd.Uuid)
+		if err != nil {
+			return err
+		}
+		if deleted, err = res.RowsAffected(); err != nil {
+			return err
+		}
+		if start.Int64 != 0 {
+			cmd.SystemName, cmd.ProcessId, cmd.ProcessStartTime = systemName.String, int(pid.Int64), start.Int64
+			if err := cmd.sessionRefresh(ctx, tx); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+	return deleted, err
 }
 
-func (sys System) systemUpdate() int64 {
+// sessionRefresh updates cmd's session from its remaining commands after one
+// has been deleted, and deletes it when there are none.
+func (cmd Command) sessionRefresh(ctx context.Context, tx *sql.Tx) error {
+	const session = `
+	WHERE "user_id" = $1 AND "system_name" = $2 AND "process_id" = $3 AND "process_start_time" = $4`
+	const commands = `
+		FROM commands c WHERE c."user_id" = sessions."user_id" AND c."system_name" = sessions."system_name"
+		AND c."process_id" = sessions."process_id" AND c."process_start_time" = sessions."process_start_time"`
+	args := []interface{}{cmd.User.ID, cmd.SystemName, cmd.ProcessId, cmd.ProcessStartTime}
+	_, err := txExec(ctx, tx, `DELETE FROM sessions`+session+` AND NOT EXISTS (SELECT 1`+commands+`)`, args...)
+	if err != nil {
+		return err
+	}
+	_, err = txExec(ctx, tx, `
+	UPDATE sessions SET
+		"total_commands" = (SELECT count(*)`+commands+`),
+		"first_command" = (SELECT min(c."created")`+commands+`),
+		"last_command" = (SELECT max(c."created")`+commands+`),
+		"first_path" = (SELECT c."path"`+commands+` ORDER BY c."created" LIMIT 1),
+		"last_path" = (SELECT c."path"`+commands+` ORDER BY c."created" DESC LIMIT 1)`+session, args...)
+	return err
+}
+
+func (sys System) systemUpdate(ctx context.Context) (int64, error) {
 
 	t := time.Now().Unix()
-	res, err := db.Exec(`
+	res, err := db.ExecContext(ctx, `
 	UPDATE systems 
 		SET "hostname" = $1 , "updated" = $2
 		WHERE "user_id" = $3
 		AND "mac" = $4`,
 		sys.Hostname, t, sys.User.ID, sys.Mac)
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
-	inserted, err := res.RowsAffected()
-	if err != nil {
-		log.Fatal(err)
-	}
-	return inserted
+	return res.RowsAffected()
 }
 
-func (sys System) systemInsert() int64 {
+func (sys System) systemInsert(ctx context.Context) (int64, error) {
 
 	t := time.Now().Unix()
-	res, err := db.Exec(`INSERT INTO systems ("name", "mac", "user_id", "hostname", "client_version", "created", "updated")
+	res, err := db.ExecContext(ctx, `INSERT INTO systems ("name", "mac", "user_id", "hostname", "client_version", "created", "updated")
  									  VALUES ($1, $2, $3, $4, $5, $6, $7)`,
 		sys.Name, sys.Mac, sys.User.ID, sys.Hostname, sys.ClientVersion, t, t)
 	if err != nil {
-		log.Fatal(err)
-	}
-	inserted, err := res.RowsAffected()
-	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
-	return inserted
+	return res.RowsAffected()
 }
 
-func (sys System) systemGet() (System, error) {
+func (sys System) systemGet(ctx context.Context) (System, error) {
 	var row System
-	err := db.QueryRow(`SELECT "name", "mac", "user_id", "hostname", "client_version",
+	err := db.QueryRowContext(ctx, `SELECT "name", "mac", "user_id", "hostname", "client_version",
  									  "id", "created", "updated" FROM systems 
  							  WHERE  "user_id" = $1
  							  AND "mac" = $2`,
@@ -530,44 +838,320 @@ func (sys System) systemGet() (System, error) {
 
 }
 
-func (status Status) statusGet() (Status, error) {
-	var err error
-	if connectionLimit != 1 {
-		err = db.QueryRow(`
-		select
-      		( select count(*) from commands where user_id = $1) as totalCommands,
-      		( select count(distinct process_id) from commands where user_id = $1) as totalSessions,
-      		( select count(*) from systems where user_id = $1) as totalSystems,
-      		( select count(*) from commands where to_timestamp(cast(created/1000 as bigint))::date = now()::date and  user_id = $1) as totalCommandsToday,
-      		( select count(*) from commands where process_id = $2) as sessionTotalCommands`,
-			status.User.ID, status.ProcessID).Scan(
-			&status.TotalCommands, &status.TotalSessions, &status.TotalSystems,
-			&status.TotalCommandsToday, &status.SessionTotalCommands)
-	} else {
-		err = db.QueryRow(`
-		select
-      		( select count(*) from commands where user_id = $1) as totalCommands,
-      		( select count(distinct process_id) from commands where user_id = $1) as totalSessions,
-      		( select count(*) from systems where user_id = $1) as totalSystems,
-      		( select count(*) from commands where date(created/1000, 'unixepoch') = date('now') and  user_id = $1) as totalCommandsToday,
-      		( select count(*) from commands where process_id = $2) as sessionTotalCommands`,
-			status.User.ID, status.ProcessID).Scan(
-			&status.TotalCommands, &status.TotalSessions, &status.TotalSystems,
-			&status.TotalCommandsToday, &status.SessionTotalCommands)
+// statusTopCommands is how many of the day's most run commands are in a
+// status.
+const statusTopCommands = 5
+
+// statusGet returns the user's stats, those of their system and those of the
+// session started by status.ProcessID at status.SessionStartTime on it.
+func (status Status) statusGet(ctx context.Context, now time.Time) (Status, error) {
+	year, month, day := now.Date()
+	today := time.Date(year, month, day, 0, 0, 0, 0, now.Location()).UnixNano() / int64(time.Millisecond)
+	err := db.QueryRowContext(ctx, `
+	SELECT
+		(SELECT count(*) FROM commands WHERE "user_id" = $1) AS totalCommands,
+		(SELECT count(*) FROM sessions WHERE "user_id" = $1) AS totalSessions,
+		(SELECT count(*) FROM systems WHERE "user_id" = $1) AS totalSystems,
+		(SELECT count(*) FROM commands WHERE "user_id" = $1 AND "created" >= $2) AS totalCommandsToday,
+		(SELECT count(*) FROM commands WHERE "user_id" = $1 AND "system_name" = $3) AS systemTotalCommands,
+		(SELECT count(*) FROM sessions WHERE "user_id" = $1 AND "system_name" = $3) AS systemTotalSessions,
+		(SELECT coalesce(sum("total_commands"), 0) FROM sessions
+			WHERE "user_id" = $1 AND "system_name" = $3
+			AND "process_id" = $4 AND "process_start_time" = $5) AS sessionTotalCommands`,
+		status.User.ID, today, status.SystemName, status.ProcessID, status.SessionStartTime).Scan(
+		&status.TotalCommands, &status.TotalSessions, &status.TotalSystems, &status.TotalCommandsToday,
+		&status.SystemTotalCommands, &status.SystemTotalSessions, &status.SessionTotalCommands)
+	if err != nil {
+		return Status{}, err
 	}
+
+	rows, err := db.QueryContext(ctx, `
+	SELECT "command", count(*) AS "runs"
+		FROM commands
+		WHERE "user_id" = $1
+		AND "created" >= $2
+	GROUP BY "command" ORDER BY "runs" DESC, "command" LIMIT $3`, status.User.ID, today, statusTopCommands)
 	if err != nil {
 		return Status{}, err
 	}
-	return status, err
+	defer rows.Close()
+	status.TopCommandsToday = []CommandCount{}
+	for rows.Next() {
+		var top CommandCount
+		if err := rows.Scan(&top.Command, &top.Count); err != nil {
+			return Status{}, err
+		}
+		status.TopCommandsToday = append(status.TopCommandsToday, top)
+	}
+	if err := rows.Err(); err != nil {
+		return Status{}, err
+	}
+
+	err = db.QueryRowContext(ctx, `
+	SELECT "path"
+		FROM commands
+		WHERE "user_id" = $1
+		AND "created" >= $2
+		AND "path" IS NOT NULL
+	GROUP BY "path" ORDER BY count(*) DESC, "path" LIMIT 1`, status.User.ID, today).Scan(&status.MostActivePathToday)
+	if err != nil && err != sql.ErrNoRows {
+		return Status{}, err
+	}
+	return status, nil
+}
+
+// importCommands adds imports to username's history in one transaction and
+// returns how many weren't already there.
+func importCommands(ctx context.Context, username string, imports []Import) (int64, error) {
+	var imported int64
+	err := retryBusy(ctx, func() error {
+		imported = 0
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		for _, imp := range imports {
+			res, err := txExec(ctx, tx, `
+			INSERT INTO commands ("command", "path", "created", "uuid", "exit_status","system_name", "session_id",
+				"start_time", "end_time", "duration", "user_id" )
+			VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10 ,(select "id" from users where "username" = $11)) ON CONFLICT do nothing`,
+				imp.Command, imp.Path, imp.Created, imp.Uuid, imp.ExitStatus, imp.SystemName, imp.SessionID,
+				nullIfZero(imp.StartTime), nullIfZero(imp.EndTime), nullIfZero(imp.Duration), username)
+			if err != nil {
+				return err
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			imported += n
+		}
+		return tx.Commit()
+	})
+	return imported, err
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
 }
 
-func importCommands(imp Import) error {
-	_, err := db.Exec(`
-	INSERT INTO commands ("command", "path", "created", "uuid", "exit_status","system_name", "session_id", "user_id" )
-	VALUES ($1,$2,$3,$4,$5,$6,$7 ,(select "id" from users where "username" = $8)) ON CONFLICT do nothing`,
-		imp.Command, imp.Path, imp.Created, imp.Uuid, imp.ExitStatus, imp.SystemName, imp.SessionID, imp.Username)
+func (key APIKey) apiKeyCreate(ctx context.Context) (APIKey, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return APIKey{}, err
+	}
+	key.Key = apiKeyPrefix + hex.EncodeToString(b)
+	key.Prefix = key.Key[:len(apiKeyPrefix)+8]
+	key.Hash = hashAPIKey(key.Key)
+	key.Created = time.Now().Unix()
+
+	_, err := db.ExecContext(ctx, `
+	INSERT INTO api_keys ("name", "scope", "prefix", "hash", "created", "last_used", "user_id")
+	VALUES ($1, $2, $3, $4, $5, 0, $6)`,
+		key.Name, key.Scope, key.Prefix, key.Hash, key.Created, key.User.ID)
 	if err != nil {
-		return err
+		return APIKey{}, err
 	}
-	return nil
+	err = db.QueryRowContext(ctx, `SELECT "id" FROM api_keys WHERE "hash" = $1`, key.Hash).Scan(&key.ID)
+	if err != nil {
+		return APIKey{}, err
+	}
+	return key, nil
+}
+
+func (key APIKey) apiKeyList(ctx context.Context) ([]APIKey, error) {
+	var results []APIKey
+	rows, err := db.QueryContext(ctx, `
+	SELECT "id", "name", "scope", "prefix", "created", "last_used"
+		FROM api_keys
+		WHERE "user_id" = $1
+	ORDER BY "created" DESC`, key.User.ID)
+	if err != nil {
+		return []APIKey{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var result APIKey
+		err = rows.Scan(&result.ID, &result.Name, &result.Scope, &result.Prefix, &result.Created, &result.LastUsed)
+		if err != nil {
+			return []APIKey{}, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+func (key APIKey) apiKeyDelete(ctx context.Context) (int64, error) {
+	res, err := db.ExecContext(ctx, `
+	DELETE FROM api_keys WHERE "user_id" = $1 AND "id" = $2`, key.User.ID, key.ID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// apiKeyLastUsedInterval is how stale last_used has to be before a lookup
+// updates it, so busy keys don't write on every request.
+const apiKeyLastUsedInterval = 60
+
+// apiKeyLookup resolves a plaintext api key to its owner and scope and
+// records when it was last used.
+func (key APIKey) apiKeyLookup(ctx context.Context) (APIKey, error) {
+	var result APIKey
+	var lastUsed sql.NullInt64
+	err := db.QueryRowContext(ctx, `
+	SELECT k."id", k."name", k."scope", k."user_id", u."username", k."last_used"
+		FROM api_keys k
+		JOIN users u ON u."id" = k."user_id"
+		WHERE k."hash" = $1`, hashAPIKey(key.Key)).Scan(&result.ID, &result.Name, &result.Scope,
+		&result.User.ID, &result.User.Username, &lastUsed)
+	if err != nil {
+		return APIKey{}, err
+	}
+	now := time.Now().Unix()
+	if now-lastUsed.Int64 < apiKeyLastUsedInterval {
+		result.LastUsed = lastUsed.Int64
+		return result, nil
+	}
+	result.LastUsed = now
+	_, err = db.ExecContext(ctx, `UPDATE api_keys SET "last_used" = $1 WHERE "id" = $2`, now, result.ID)
+	if err != nil {
+		return APIKey{}, err
+	}
+	return result, nil
+}
+
+func (event AuditEvent) auditInsert(ctx context.Context) error {
+	_, err := db.ExecContext(ctx, `
+	INSERT INTO audit_events ("created", "type", "username", "user_id", "ip", "detail")
+	VALUES ($1, $2, $3, $4, $5, $6)`,
+		event.Created, event.Type, event.Username, event.UserId, event.IP, event.Detail)
+	return err
+}
+
+func (f SessionFilter) sessionList(ctx context.Context) ([]Session, error) {
+	args := []interface{}{f.UserId}
+	where := []string{`"user_id" = $1`}
+	add := func(clause string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(clause, len(args)))
+	}
+	if f.SystemName != "" {
+		add(`"system_name" = $%v`, f.SystemName)
+	}
+	if f.Since != 0 {
+		add(`"last_command" >= $%v`, f.Since)
+	}
+	if f.Until != 0 {
+		add(`"first_command" < $%v`, f.Until)
+	}
+	args = append(args, f.Limit)
+	query := fmt.Sprintf(`
+	SELECT "id", "system_name", "process_id", "process_start_time", "first_command", "last_command",
+		"first_path", "last_path", "total_commands"
+		FROM sessions
+		WHERE %v
+	ORDER BY "last_command" DESC, "id" DESC LIMIT $%v`, strings.Join(where, " AND "), len(args))
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []Session
+	for rows.Next() {
+		var result Session
+		err = rows.Scan(&result.ID, &result.SystemName, &result.ProcessId, &result.ProcessStartTime,
+			&result.FirstCommand, &result.LastCommand, &result.FirstPath, &result.LastPath, &result.TotalCommands)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+// sessionGet returns a user's session with its commands.
+func sessionGet(ctx context.Context, userID uint, id uint64) (Session, error) {
+	var s Session
+	err := db.QueryRowContext(ctx, `
+	SELECT "id", "system_name", "process_id", "process_start_time", "first_command", "last_command",
+		"first_path", "last_path", "total_commands"
+		FROM sessions
+		WHERE "id" = $1
+	AND "user_id" = $2`, id, userID).Scan(&s.ID, &s.SystemName, &s.ProcessId, &s.ProcessStartTime,
+		&s.FirstCommand, &s.LastCommand, &s.FirstPath, &s.LastPath, &s.TotalCommands)
+	if err != nil {
+		return Session{}, err
+	}
+	rows, err := db.QueryContext(ctx, `
+	SELECT "command", "path", "created", "uuid", "exit_status", "system_name"
+		FROM commands
+		WHERE "user_id" = $1
+		AND "system_name" = $2
+		AND "process_id" = $3
+		AND "process_start_time" = $4
+	ORDER BY "created", "uuid"`, userID, s.SystemName, s.ProcessId, s.ProcessStartTime)
+	if err != nil {
+		return Session{}, err
+	}
+	defer rows.Close()
+	s.Commands = []Query{}
+	for rows.Next() {
+		var result Query
+		err = rows.Scan(&result.Command, &result.Path, &result.Created, &result.Uuid, &result.ExitStatus, &result.SystemName)
+		if err != nil {
+			return Session{}, err
+		}
+		s.Commands = append(s.Commands, result)
+	}
+	return s, rows.Err()
+}
+
+func (f AuditFilter) auditGet(ctx context.Context) ([]AuditEvent, error) {
+	var (
+		results []AuditEvent
+		where   []string
+		args    []interface{}
+	)
+	add := func(clause string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(clause, len(args)))
+	}
+	if f.Username != "" {
+		add(`"username" = $%v`, f.Username)
+	}
+	if f.Type != "" {
+		add(`"type" = $%v`, f.Type)
+	}
+	if f.Since != 0 {
+		add(`"created" >= $%v`, f.Since)
+	}
+	if f.Until != 0 {
+		add(`"created" < $%v`, f.Until)
+	}
+	query := `SELECT "id", "created", "type", "username", "user_id", "ip", "detail" FROM audit_events`
+	if len(where) != 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	args = append(args, f.Limit)
+	query += fmt.Sprintf(` ORDER BY "created" DESC, "id" DESC LIMIT $%v`, len(args))
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return []AuditEvent{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var result AuditEvent
+		err = rows.Scan(&result.ID, &result.Created, &result.Type, &result.Username, &result.UserId,
+			&result.IP, &result.Detail)
+		if err != nil {
+			return []AuditEvent{}, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
 }
@@ -0,0 +1,133 @@
+/*
+ *
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// SlowCommand is how long a command took over all of its timed runs, in
+// milliseconds.
+type SlowCommand struct {
+	Command string `json:"command"`
+	Runs    int    `json:"runs"`
+	Total   int64  `json:"totalMs"`
+	Average int64  `json:"averageMs"`
+	Longest int64  `json:"longestMs"`
+}
+
+// slowestOrders are the columns the slowest commands can be ordered by.
+var slowestOrders = map[string]string{
+	"total":   `"total"`,
+	"average": `"average"`,
+	"longest": `"longest"`,
+}
+
+// timing checks cmd's optional start and end times and duration agree, and
+// works out whichever of them is missing from the other two.
+func (cmd *Command) timing() error {
+	switch {
+	case cmd.Duration < 0:
+		return errors.New("durationMs can't be negative")
+	case cmd.StartTime != 0 && cmd.EndTime != 0 && cmd.EndTime < cmd.StartTime:
+		return errors.New("endTime can't be before startTime")
+	case cmd.StartTime != 0 && cmd.EndTime != 0 && cmd.Duration != 0 && cmd.Duration != cmd.EndTime-cmd.StartTime:
+		return fmt.Errorf("durationMs is %v but endTime is %v after startTime", cmd.Duration, cmd.EndTime-cmd.StartTime)
+	case cmd.StartTime != 0 && cmd.EndTime != 0:
+		cmd.Duration = cmd.EndTime - cmd.StartTime
+	case cmd.StartTime != 0 && cmd.Duration != 0:
+		cmd.EndTime = cmd.StartTime + cmd.Duration
+	case cmd.EndTime != 0 && cmd.Duration != 0:
+		cmd.StartTime = cmd.EndTime - cmd.Duration
+	}
+	return nil
+}
+
+// parseMilliseconds parses a number of milliseconds or a duration like 1m30s.
+func parseMilliseconds(s string) (int64, error) {
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil && ms >= 0 {
+		return ms, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("%q isn't a number of milliseconds or a duration", s)
+	}
+	return int64(d / time.Millisecond), nil
+}
+
+// jsonMilliseconds is a duration in JSON written either as a number of
+// milliseconds or as a string parseMilliseconds accepts, such as "1m".
+type jsonMilliseconds int64
+
+func (ms *jsonMilliseconds) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		s = string(b)
+	}
+	n, err := parseMilliseconds(s)
+	if err != nil {
+		return err
+	}
+	*ms = jsonMilliseconds(n)
+	return nil
+}
+
+// commandSlowest lists the timed commands matching cmd's filters that took
+// the most time in total, on average or at longest, run between since and
+// until when they aren't zero.
+func (cmd Command) commandSlowest(ctx context.Context, by string, since, until int64) ([]SlowCommand, error) {
+	args, filters := cmd.searchFilters(nil)
+	filters += ` AND "duration" IS NOT NULL`
+	if since != 0 {
+		args = append(args, since)
+		filters += fmt.Sprintf(` AND "created" >= $%v`, len(args))
+	}
+	if until != 0 {
+		args = append(args, until)
+		filters += fmt.Sprintf(` AND "created" < $%v`, len(args))
+	}
+	args = append(args, cmd.Limit)
+	// postgres sums bigints as numeric, so the sums are cast back to integers.
+	query := fmt.Sprintf(`
+	SELECT "command", count(*) AS "runs", CAST(sum("duration") AS BIGINT) AS "total",
+		CAST(sum("duration") / count(*) AS BIGINT) AS "average", max("duration") AS "longest"
+		FROM commands
+		WHERE %v
+	GROUP BY "command" ORDER BY %v DESC, "command" LIMIT $%v`, filters, slowestOrders[by], len(args))
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	results := []SlowCommand{}
+	for rows.Next() {
+		var result SlowCommand
+		if err := rows.Scan(&result.Command, &result.Runs, &result.Total, &result.Average, &result.Longest); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
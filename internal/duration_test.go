@@ -0,0 +1,84 @@
+/*
+ *
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMilliseconds(t *testing.T) {
+	for s, want := range map[string]int64{"1500": 1500, "0": 0, "90s": 90000, "1m30s": 90000, "250ms": 250} {
+		got, err := parseMilliseconds(s)
+		assert.Nil(t, err, s)
+		assert.Equal(t, want, got, s)
+	}
+	for _, s := range []string{"", "-1", "-1s", "soon"} {
+		_, err := parseMilliseconds(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestMillisecondsJSON(t *testing.T) {
+	for s, want := range map[string]jsonMilliseconds{`1500`: 1500, `"1500"`: 1500, `"1m"`: 60000, `"1m30s"`: 90000} {
+		var got jsonMilliseconds
+		assert.Nil(t, json.Unmarshal([]byte(s), &got), s)
+		assert.Equal(t, want, got, s)
+	}
+	for _, s := range []string{`-1`, `"soon"`, `true`} {
+		var got jsonMilliseconds
+		assert.NotNil(t, json.Unmarshal([]byte(s), &got), s)
+	}
+}
+
+func TestTiming(t *testing.T) {
+	cmd := Command{StartTime: 1000, EndTime: 4500}
+	assert.Nil(t, cmd.timing())
+	assert.Equal(t, int64(3500), cmd.Duration)
+
+	// a given duration has to match the times
+	cmd = Command{StartTime: 1000, EndTime: 4500, Duration: 3500}
+	assert.Nil(t, cmd.timing())
+	assert.Equal(t, int64(3500), cmd.Duration)
+	cmd = Command{StartTime: 1000, EndTime: 4500, Duration: 3000}
+	assert.NotNil(t, cmd.timing())
+
+	// the missing time is worked out from the other and the duration
+	cmd = Command{StartTime: 1000, Duration: 3500}
+	assert.Nil(t, cmd.timing())
+	assert.Equal(t, int64(4500), cmd.EndTime)
+	cmd = Command{EndTime: 4500, Duration: 3500}
+	assert.Nil(t, cmd.timing())
+	assert.Equal(t, int64(1000), cmd.StartTime)
+
+	cmd = Command{StartTime: 1000}
+	assert.Nil(t, cmd.timing())
+	assert.Equal(t, int64(0), cmd.Duration)
+	assert.Equal(t, int64(0), cmd.EndTime)
+	cmd = Command{Duration: 3500}
+	assert.Nil(t, cmd.timing())
+	assert.Equal(t, int64(0), cmd.StartTime)
+
+	cmd = Command{StartTime: 4500, EndTime: 1000}
+	assert.NotNil(t, cmd.timing())
+	cmd = Command{Duration: -1}
+	assert.NotNil(t, cmd.timing())
+}
@@ -0,0 +1,139 @@
+/*
+ *
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Error codes sent in the errorCode field of error responses. Unlike the
+// messages they don't change, so clients can match on them.
+const (
+	errCodeBadRequest     = "bad_request"
+	errCodeUnauthorized   = "unauthorized"
+	errCodeNotFound       = "not_found"
+	errCodeForbidden      = "forbidden"
+	errCodeConflict       = "conflict"
+	errCodeUnsupported    = "unsupported"
+	errCodeRateLimited    = "rate_limited"
+	errCodeSearchTimeout  = "search_timeout"
+	errCodeNoFTS          = "fts_unavailable"
+	errCodeDBBusy         = "db_busy"
+	errCodeDBTimeout      = "db_timeout"
+	errCodeDBUnavailable  = "db_unavailable"
+	errCodeIDPUnavailable = "idp_unavailable"
+	errCodeInternal       = "internal"
+)
+
+// dbRetries is how many times a statement is retried when the db is busy.
+const dbRetries = 3
+
+// respondError aborts the request with a JSON error response.
+func respondError(c *gin.Context, status int, code string, err error) {
+	c.AbortWithStatusJSON(status, gin.H{"error": err.Error(), "errorCode": code})
+}
+
+// respondDBError aborts the request with the response for a db error. Details
+// of server side failures are only logged, the client gets the request id to
+// report instead.
+func respondDBError(c *gin.Context, err error) {
+	status, code := dbErrorStatus(err)
+	if status < 500 {
+		respondError(c, status, code, err)
+		return
+	}
+	_ = c.Error(err)
+	if status == http.StatusServiceUnavailable {
+		c.Header("Retry-After", "1")
+	}
+	c.AbortWithStatusJSON(status, gin.H{
+		"error":     http.StatusText(status),
+		"errorCode": code,
+		"requestId": c.Writer.Header().Get("X-Request-ID"),
+	})
+}
+
+// dbErrorStatus maps a db error to a http status and error code.
+func dbErrorStatus(err error) (int, string) {
+	var pqErr *pq.Error
+	var netErr net.Error
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return http.StatusNotFound, errCodeNotFound
+	case dbBusy(err):
+		return http.StatusServiceUnavailable, errCodeDBBusy
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusServiceUnavailable, errCodeDBTimeout
+	case errors.Is(err, driver.ErrBadConn), errors.As(err, &netErr):
+		return http.StatusServiceUnavailable, errCodeDBUnavailable
+	case errors.As(err, &pqErr) && pqErr.Code.Class() == "22":
+		// data exceptions, such as an invalid regular expression
+		return http.StatusBadRequest, errCodeBadRequest
+	case strings.Contains(err.Error(), "error parsing regexp"):
+		// returned by the sqlite regexp function
+		return http.StatusBadRequest, errCodeBadRequest
+	}
+	return http.StatusInternalServerError, errCodeInternal
+}
+
+// dbBusy reports whether err is a lock conflict that's worth retrying.
+func dbBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "40001", "40P01", "55P03":
+			// serialization_failure, deadlock_detected, lock_not_available
+			return true
+		}
+	}
+	return false
+}
+
+// retryBusy runs f until it succeeds, fails with an error other than the db
+// being busy, or has been retried dbRetries times.
+func retryBusy(ctx context.Context, f func() error) error {
+	backoff := 50 * time.Millisecond
+	var err error
+	for i := 0; ; i++ {
+		if err = f(); err == nil || !dbBusy(err) || i == dbRetries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
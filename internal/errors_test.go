@@ -0,0 +1,83 @@
+/*
+ *
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDBErrorStatus(t *testing.T) {
+	for _, tc := range []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{sql.ErrNoRows, 404, errCodeNotFound},
+		{fmt.Errorf("lookup: %w", sql.ErrNoRows), 404, errCodeNotFound},
+		{sqlite3.Error{Code: sqlite3.ErrBusy}, 503, errCodeDBBusy},
+		{sqlite3.Error{Code: sqlite3.ErrLocked}, 503, errCodeDBBusy},
+		{&pq.Error{Code: "40P01"}, 503, errCodeDBBusy},
+		{context.DeadlineExceeded, 503, errCodeDBTimeout},
+		{&pq.Error{Code: "2201B"}, 400, errCodeBadRequest},
+		{errors.New("error parsing regexp: missing closing )"), 400, errCodeBadRequest},
+		{&pq.Error{Code: "42P01"}, 500, errCodeInternal},
+		{errors.New("disk I/O error"), 500, errCodeInternal},
+	} {
+		status, code := dbErrorStatus(tc.err)
+		assert.Equal(t, tc.status, status, tc.err.Error())
+		assert.Equal(t, tc.code, code, tc.err.Error())
+	}
+}
+
+func TestRetryBusy(t *testing.T) {
+	calls := 0
+	err := retryBusy(context.Background(), func() error {
+		calls++
+		if calls < 3 {
+			return sqlite3.Error{Code: sqlite3.ErrBusy}
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	err = retryBusy(context.Background(), func() error {
+		calls++
+		return sqlite3.Error{Code: sqlite3.ErrLocked}
+	})
+	assert.True(t, dbBusy(err))
+	assert.Equal(t, dbRetries+1, calls)
+
+	calls = 0
+	err = retryBusy(context.Background(), func() error {
+		calls++
+		return errors.New("constraint failed")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls)
+}
@@ -0,0 +1,101 @@
+/*
+ *
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// frecencyWeights are what a run of a command adds to its frecency by its age,
+// runs older than all of them add frecencyOldWeight.
+var frecencyWeights = []struct {
+	age    time.Duration
+	weight int
+}{
+	{4 * 24 * time.Hour, 100},
+	{14 * 24 * time.Hour, 70},
+	{31 * 24 * time.Hour, 50},
+	{90 * 24 * time.Hour, 30},
+}
+
+const (
+	frecencyOldWeight = 10
+	// runs in the caller's current directory or on their current system
+	// count this many times over
+	frecencyPathBoost   = 3
+	frecencySystemBoost = 2
+)
+
+// frecencyContext is where a search is made from.
+type frecencyContext struct {
+	Path       string
+	SystemName string
+}
+
+// commandGetFrecent lists cmd's user's commands once each, ranked by
+// frecency: the sum of each run's weight by its age at now, in unix
+// milliseconds, boosted when it was run in here's path or system.
+func (cmd Command) commandGetFrecent(ctx context.Context, now int64, here frecencyContext) ([]Query, error) {
+	// sqlite numbers parameters in the order they appear, so they're added
+	// in the order they're used
+	args := []interface{}{now}
+	weight := "CASE"
+	for _, w := range frecencyWeights {
+		weight += fmt.Sprintf(` WHEN $1 - "created" < %v THEN %v`, w.age.Milliseconds(), w.weight)
+	}
+	weight += fmt.Sprintf(` ELSE %v END`, frecencyOldWeight)
+	if here.Path != "" {
+		args = append(args, here.Path)
+		weight += fmt.Sprintf(` * CASE WHEN "path" = $%v THEN %v ELSE 1 END`, len(args), frecencyPathBoost)
+	}
+	if here.SystemName != "" {
+		args = append(args, here.SystemName)
+		weight += fmt.Sprintf(` * CASE WHEN "system_name" = $%v THEN %v ELSE 1 END`, len(args), frecencySystemBoost)
+	}
+
+	args, filters := cmd.searchFilters(args)
+	// sqlite takes the uuid from the row with the max created
+	uuid := `"uuid"`
+	if connectionLimit != 1 {
+		uuid = `(array_agg("uuid" ORDER BY "created" DESC))[1]`
+	}
+	args = append(args, cmd.Limit)
+	query := fmt.Sprintf(`
+	SELECT "command", %v, max("created") AS "latest", sum(%v) AS "score"
+		FROM commands
+		WHERE %v
+	GROUP BY "command" ORDER BY "score" DESC, "latest" DESC LIMIT $%v`, uuid, weight, filters, len(args))
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []Query
+	for rows.Next() {
+		var result Query
+		if err := rows.Scan(&result.Command, &result.Uuid, &result.Created, &result.Score); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
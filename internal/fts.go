@@ -0,0 +1,202 @@
+/*
+ *
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ftsUnavailable is why full text search can't be used, or nil when it can.
+var ftsUnavailable error
+
+// ftsInit sets up the full text index of commands. On postgres it's a
+// generated tsvector column with a GIN index, which needs postgres 12. On
+// sqlite it's an fts5 table kept in sync by triggers, which needs a build
+// with the sqlite_fts5 tag. The fts5 table has its own copy of each command
+// and is joined on uuid, since commands has no primary key and its rowids
+// can change on VACUUM. Without either search works as before and mode=fts
+// is rejected. A build without the tag drops the triggers of one with it, so
+// the database can still be written to, and the index is rebuilt when a build
+// with the tag opens it again.
+func ftsInit() {
+	if connectionLimit != 1 {
+		_, err := db.Exec(`
+		ALTER TABLE commands ADD COLUMN IF NOT EXISTS "command_tsv" tsvector
+			GENERATED ALWAYS AS (to_tsvector('simple', "command")) STORED;
+		CREATE INDEX IF NOT EXISTS idx_commands_tsv ON commands USING GIN ("command_tsv");`)
+		if err != nil {
+			ftsDisable(err)
+		}
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		ftsDisable(err)
+		return
+	}
+	defer tx.Rollback()
+	var exists, indexed bool
+	err = tx.QueryRow(`
+	SELECT count(*) FILTER (WHERE "type" = 'table') > 0, count(*) FILTER (WHERE "type" = 'trigger') > 0
+		FROM sqlite_master WHERE "name" IN ('commands_fts', 'commands_fts_insert')`).Scan(&exists, &indexed)
+	if err != nil {
+		ftsDisable(err)
+		return
+	}
+	if exists {
+		// CREATE VIRTUAL TABLE IF NOT EXISTS doesn't check for the module
+		_, err = tx.Exec(`SELECT 1 FROM commands_fts LIMIT 0`)
+	}
+	if err == nil {
+		_, err = tx.Exec(`
+		CREATE VIRTUAL TABLE IF NOT EXISTS commands_fts USING fts5("command", "uuid" UNINDEXED);
+		CREATE TRIGGER IF NOT EXISTS commands_fts_insert AFTER INSERT ON commands
+		BEGIN INSERT INTO commands_fts ("command", "uuid") VALUES (new."command", new."uuid"); END;
+		CREATE TRIGGER IF NOT EXISTS commands_fts_delete AFTER DELETE ON commands
+		BEGIN DELETE FROM commands_fts WHERE "uuid" = old."uuid"; END;
+		CREATE TRIGGER IF NOT EXISTS commands_fts_update AFTER UPDATE OF "command", "uuid" ON commands
+		BEGIN UPDATE commands_fts SET "command" = new."command", "uuid" = new."uuid" WHERE "uuid" = old."uuid"; END;`)
+	}
+	if err != nil && strings.Contains(err.Error(), "no such module: fts5") {
+		// a database from a build with the tag keeps its triggers, which
+		// would fail every write to commands without the module
+		_, err = tx.Exec(`
+		DROP TRIGGER IF EXISTS commands_fts_insert;
+		DROP TRIGGER IF EXISTS commands_fts_delete;
+		DROP TRIGGER IF EXISTS commands_fts_update;`)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err == nil {
+			err = errors.New("built without the sqlite_fts5 tag")
+		}
+		ftsDisable(err)
+		return
+	}
+	if err != nil {
+		ftsDisable(err)
+		return
+	}
+	if !exists || !indexed {
+		// index the commands from before the table existed, or that were
+		// saved by a build without the tag, which dropped the triggers. The
+		// table has its own copy of each command, so fts5's rebuild would
+		// only reindex the stale copies.
+		_, err = tx.Exec(`
+		DELETE FROM commands_fts;
+		INSERT INTO commands_fts ("command", "uuid") SELECT "command", "uuid" FROM commands;`)
+		if err != nil {
+			ftsDisable(err)
+			return
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		ftsDisable(err)
+	}
+}
+
+func ftsDisable(err error) {
+	ftsUnavailable = err
+	logger.WithError(err).Warn("full text search is unavailable")
+}
+
+// ftsQuery turns a search into an fts5 query matching commands that have all
+// of its words. Each word is quoted so punctuation, such as in -n or
+// deploy/api, is split into a phrase by the tokenizer instead of being read
+// as query syntax.
+func ftsQuery(search string) string {
+	words := strings.Fields(search)
+	for i, w := range words {
+		words[i] = `"` + strings.ReplaceAll(w, `"`, `""`) + `"`
+	}
+	return strings.Join(words, " ")
+}
+
+// commandSearchFTS finds cmd's user's commands that contain all of the words
+// in cmd.Query, best matches first and the most recent of equally good ones.
+// With cmd.Unique each command is listed once, as uniqueRuns does.
+func (cmd Command) commandSearchFTS(ctx context.Context) ([]Query, error) {
+	args := []interface{}{cmd.User.ID}
+	filters := ""
+	filter := func(column string, value string) {
+		args = append(args, value)
+		filters += fmt.Sprintf(` AND c."%v" = $%v`, column, len(args))
+	}
+	if cmd.Path != "" {
+		filter("path", cmd.Path)
+	}
+	if cmd.SystemName != "" {
+		filter("system_name", cmd.SystemName)
+	}
+	if cmd.MinDuration > 0 {
+		args = append(args, cmd.MinDuration)
+		filters += fmt.Sprintf(` AND c."duration" >= $%v`, len(args))
+	}
+
+	var matches string
+	if connectionLimit != 1 {
+		args = append(args, cmd.Query)
+		matches = fmt.Sprintf(`
+		SELECT c."command", c."uuid", c."created", c."path", c."system_name", -ts_rank(c."command_tsv", q) AS "score"
+			FROM commands c, plainto_tsquery('simple', $%v) q
+			WHERE c."user_id" = $1 %v
+			AND c."command_tsv" @@ q`, len(args), filters)
+	} else {
+		// sqlite numbers parameters in the order they appear
+		args = append(args, ftsQuery(cmd.Query))
+		matches = fmt.Sprintf(`
+		SELECT c."command", c."uuid", c."created", c."path", c."system_name", commands_fts."rank" AS "score"
+			FROM commands_fts
+			JOIN commands c ON c."uuid" = commands_fts."uuid"
+			WHERE c."user_id" = $1 %v
+			AND commands_fts MATCH $%v`, filters, len(args))
+	}
+
+	args = append(args, cmd.Limit)
+	if cmd.Unique {
+		// the score is the same for each copy of a command
+		rows, err := db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT %v FROM (%v) u
+		ORDER BY "score", "created" DESC, "uuid" DESC LIMIT $%v`, uniqueColumns, uniqueRuns(matches), len(args)), args...)
+		if err != nil {
+			return nil, err
+		}
+		return scanUnique(rows)
+	}
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`
+	SELECT "command", "uuid", "created" FROM (%v) m
+	ORDER BY "score", "created" DESC, "uuid" DESC LIMIT $%v`, matches, len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []Query
+	for rows.Next() {
+		var result Query
+		if err := rows.Scan(&result.Command, &result.Uuid, &result.Created); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
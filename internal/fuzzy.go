@@ -0,0 +1,415 @@
+/*
+ *
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// maxFuzzyCandidates is how many commands a fuzzy search scores at most.
+const maxFuzzyCandidates = 2000
+
+// Fuzzy match scores, the same as fzf's.
+const (
+	fuzzyScoreMatch        = 16
+	fuzzyScoreGapStart     = -3
+	fuzzyScoreGapExtension = -1
+	// matching the first character of a word
+	fuzzyBonusBoundary = fuzzyScoreMatch / 2
+	// matching punctuation or a space
+	fuzzyBonusNonWord = fuzzyScoreMatch / 2
+	// matching the start of a camelCase word or a number
+	fuzzyBonusCamel = fuzzyBonusBoundary + fuzzyScoreGapExtension
+	// matching right after the previous match
+	fuzzyBonusConsecutive = -(fuzzyScoreGapStart + fuzzyScoreGapExtension)
+	// the first character of a term counts this many times over
+	fuzzyFirstCharMultiplier = 2
+)
+
+// trgmAvailable is whether commands have a trigram index, pg_trgm's on
+// postgres or command_trigrams on sqlite.
+var trgmAvailable bool
+
+// maxTrigramPositions is how many characters of a command are indexed on sqlite.
+const maxTrigramPositions = 1024
+
+// fuzzyInit creates the trigram index fuzzy searches pick candidates with. On
+// postgres it's pg_trgm's, a contrib extension, fuzzy search works without it
+// but scores the most recent matches rather than the most similar ones. The
+// bundled sqlite predates fts5's trigram tokenizer, so on sqlite it's the
+// command_trigrams table, the lower cased trigrams of each command kept in
+// sync by triggers. They're cut from the command by joining fuzzy_positions,
+// the numbers up to maxTrigramPositions, as triggers can't use a recursive
+// query.
+func fuzzyInit() {
+	trgmAvailable = false
+	if connectionLimit != 1 {
+		_, err := db.Exec(`
+		CREATE EXTENSION IF NOT EXISTS pg_trgm;
+		CREATE INDEX IF NOT EXISTS idx_commands_trgm ON commands USING GIST ("command" gist_trgm_ops);`)
+		if err != nil {
+			logger.WithError(err).Warn("pg_trgm is unavailable, fuzzy search won't use a trigram index")
+			return
+		}
+		trgmAvailable = true
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		logger.WithError(err).Warn("fuzzy search won't use a trigram index")
+		return
+	}
+	defer tx.Rollback()
+	var exists, indexed bool
+	err = tx.QueryRow(`
+	SELECT count(*) FILTER (WHERE "type" = 'table') > 0, count(*) FILTER (WHERE "type" = 'trigger') > 0
+		FROM sqlite_master WHERE "name" IN ('command_trigrams', 'command_trigrams_insert')`).Scan(&exists, &indexed)
+	if err == nil {
+		_, err = tx.Exec(fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS fuzzy_positions ("n" INTEGER PRIMARY KEY);
+		INSERT OR IGNORE INTO fuzzy_positions ("n")
+			WITH RECURSIVE p("n") AS (SELECT 1 UNION ALL SELECT "n" + 1 FROM p WHERE "n" < %v)
+			SELECT "n" FROM p;
+		CREATE TABLE IF NOT EXISTS command_trigrams (
+			"user_id" INTEGER NOT NULL, "trigram" TEXT NOT NULL, "uuid" TEXT NOT NULL,
+			PRIMARY KEY ("user_id", "trigram", "uuid")
+		) WITHOUT ROWID;
+		CREATE INDEX IF NOT EXISTS idx_command_trigrams_uuid ON command_trigrams ("uuid");
+		CREATE TRIGGER IF NOT EXISTS command_trigrams_insert AFTER INSERT ON commands
+		BEGIN
+			INSERT OR IGNORE INTO command_trigrams ("user_id", "trigram", "uuid")
+			SELECT new."user_id", lower(substr(new."command", "n", 3)), new."uuid"
+				FROM fuzzy_positions WHERE "n" <= length(new."command") - 2;
+		END;
+		CREATE TRIGGER IF NOT EXISTS command_trigrams_delete AFTER DELETE ON commands
+		BEGIN DELETE FROM command_trigrams WHERE "uuid" = old."uuid"; END;
+		CREATE TRIGGER IF NOT EXISTS command_trigrams_update AFTER UPDATE OF "command", "uuid", "user_id" ON commands
+		BEGIN
+			DELETE FROM command_trigrams WHERE "uuid" = old."uuid";
+			INSERT OR IGNORE INTO command_trigrams ("user_id", "trigram", "uuid")
+			SELECT new."user_id", lower(substr(new."command", "n", 3)), new."uuid"
+				FROM fuzzy_positions WHERE "n" <= length(new."command") - 2;
+		END;`, maxTrigramPositions))
+	}
+	if err == nil && (!exists || !indexed) {
+		// index the commands from before the table existed
+		_, err = tx.Exec(`
+		DELETE FROM command_trigrams;
+		INSERT OR IGNORE INTO command_trigrams ("user_id", "trigram", "uuid")
+		SELECT c."user_id", lower(substr(c."command", p."n", 3)), c."uuid"
+			FROM commands c JOIN fuzzy_positions p ON p."n" <= length(c."command") - 2;`)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		logger.WithError(err).Warn("fuzzy search won't use a trigram index")
+		return
+	}
+	trgmAvailable = true
+}
+
+// trigramsShared is a sqlite query for how many of the trigrams of the query
+// in parameter n each of user $1's commands has, as "shared", by the uuid of
+// the command, as "trigram_uuid", along with how many the query has, as
+// "trigrams".
+func trigramsShared(n int) string {
+	return fmt.Sprintf(`
+	WITH q AS (
+		SELECT DISTINCT lower(substr($%[1]v, "n", 3)) AS "trigram"
+			FROM fuzzy_positions WHERE "n" <= length($%[1]v) - 2
+	)
+	SELECT t."uuid" AS "trigram_uuid", count(*) AS "shared", (SELECT count(*) FROM q) AS "trigrams"
+		FROM command_trigrams t JOIN q ON q."trigram" = t."trigram"
+		WHERE t."user_id" = $1
+		GROUP BY t."uuid"`, n)
+}
+
+// commandSearchFuzzy finds cmd's user's commands that fuzzy match every word
+// of cmd.Query, as fzf does, best matches first. Candidates are the commands
+// containing each word's characters in order. With a trigram index they're
+// taken most similar first, otherwise most recent first, and at most
+// maxFuzzyCandidates are scored. truncated is set
+// when there were more candidates than that, so older or less similar matches
+// may be missing. With cmd.Unique the candidates are each command once, as
+// uniqueRuns lists them.
+func (cmd Command) commandSearchFuzzy(ctx context.Context) (results []Query, truncated bool, err error) {
+	terms := strings.Fields(cmd.Query)
+	args := []interface{}{cmd.User.ID}
+	filters := ""
+	filter := func(condition string, value interface{}) {
+		args = append(args, value)
+		filters += fmt.Sprintf(condition, len(args))
+	}
+	if cmd.Path != "" {
+		filter(` AND "path" = $%v`, cmd.Path)
+	}
+	if cmd.SystemName != "" {
+		filter(` AND "system_name" = $%v`, cmd.SystemName)
+	}
+	if cmd.MinDuration > 0 {
+		filter(` AND "duration" >= $%v`, cmd.MinDuration)
+	}
+	like := "LIKE"
+	if connectionLimit != 1 {
+		like = "ILIKE"
+	}
+	for _, term := range terms {
+		filter(` AND "command" `+like+` $%v ESCAPE '\'`, subsequencePattern(term))
+	}
+	candidates := fmt.Sprintf(`SELECT * FROM commands WHERE "user_id" = $1 %v`, filters)
+	columns := `"command", "uuid", "created"`
+	if cmd.Unique {
+		candidates, columns = uniqueRuns(candidates), uniqueColumns
+	}
+	from := fmt.Sprintf(`(%v) c`, candidates)
+	order := `"created" DESC`
+	switch {
+	case trgmAvailable && connectionLimit != 1:
+		args = append(args, cmd.Query)
+		order = fmt.Sprintf(`"command" <-> $%v`, len(args))
+	case trgmAvailable:
+		// similarity as pg_trgm works it out, shared trigrams over all of
+		// the trigrams of both, counting a command's trigrams by its length.
+		// sqlite numbers parameters in the order they appear.
+		args = append(args, cmd.Query)
+		from += fmt.Sprintf(` LEFT JOIN (%v) s ON s."trigram_uuid" = c."uuid"`, trigramsShared(len(args)))
+		order = `coalesce("shared", 0) * 1.0 /
+			(max(length("command") - 2, 1) + coalesce("trigrams", 0) - coalesce("shared", 0)) DESC, "created" DESC`
+	}
+	// one more than are scored tells whether there were more
+	args = append(args, maxFuzzyCandidates+1)
+	query := fmt.Sprintf(`
+	SELECT %v FROM %v
+	ORDER BY %v, "uuid" DESC LIMIT $%v`, columns, from, order, len(args))
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+	scanned := 0
+	for rows.Next() {
+		var result Query
+		dest := []interface{}{&result.Command, &result.Uuid, &result.Created}
+		if cmd.Unique {
+			dest = append(dest, &result.Path, &result.SystemName, &result.Count, &result.FirstSeen)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, false, err
+		}
+		if scanned++; scanned > maxFuzzyCandidates {
+			truncated = true
+			break
+		}
+		var ok bool
+		if result.Score, result.Positions, ok = fuzzyMatchTerms(result.Command, terms); ok {
+			results = append(results, result)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		if results[i].Created != results[j].Created {
+			return results[i].Created > results[j].Created
+		}
+		return results[i].Uuid > results[j].Uuid
+	})
+	if cmd.Limit >= 0 && len(results) > cmd.Limit {
+		results = results[:cmd.Limit]
+	}
+	return results, truncated, nil
+}
+
+// subsequencePattern returns a LIKE pattern matching strings that contain the
+// characters of term in order.
+func subsequencePattern(term string) string {
+	var b strings.Builder
+	b.WriteByte('%')
+	for _, r := range term {
+		if r == '%' || r == '_' || r == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+		b.WriteByte('%')
+	}
+	return b.String()
+}
+
+// fuzzyMatchTerms matches each of terms anywhere in text, in any order. It
+// returns the sum of their scores and the sorted rune offsets of the matched
+// characters.
+func fuzzyMatchTerms(text string, terms []string) (int, []int, bool) {
+	runes := []rune(text)
+	total := 0
+	matched := map[int]bool{}
+	for _, term := range terms {
+		score, positions, ok := fuzzyMatch(runes, []rune(term))
+		if !ok {
+			return 0, nil, false
+		}
+		total += score
+		for _, p := range positions {
+			matched[p] = true
+		}
+	}
+	positions := make([]int, 0, len(matched))
+	for p := range matched {
+		positions = append(positions, p)
+	}
+	sort.Ints(positions)
+	return total, positions, true
+}
+
+type charClass int
+
+const (
+	charNonWord charClass = iota
+	charLower
+	charUpper
+	charNumber
+)
+
+func classOf(r rune) charClass {
+	switch {
+	case unicode.IsUpper(r):
+		return charUpper
+	case unicode.IsLetter(r):
+		return charLower
+	case unicode.IsDigit(r):
+		return charNumber
+	}
+	return charNonWord
+}
+
+// bonusAt is the bonus for matching a character of class after one of prev.
+func bonusAt(prev charClass, class charClass) int {
+	switch {
+	case prev == charNonWord && class != charNonWord:
+		return fuzzyBonusBoundary
+	case prev == charLower && class == charUpper, prev != charNumber && class == charNumber:
+		return fuzzyBonusCamel
+	case class == charNonWord:
+		return fuzzyBonusNonWord
+	}
+	return 0
+}
+
+// fuzzyMatch matches pattern as a subsequence of text like fzf's v1
+// algorithm: it finds the first match, shortens it from the end and scores
+// it. It's case insensitive unless pattern has upper case letters.
+func fuzzyMatch(text []rune, pattern []rune) (int, []int, bool) {
+	if len(pattern) == 0 {
+		return 0, nil, true
+	}
+	caseSensitive := false
+	for _, r := range pattern {
+		caseSensitive = caseSensitive || unicode.IsUpper(r)
+	}
+	fold := func(r rune) rune {
+		if caseSensitive {
+			return r
+		}
+		return unicode.ToLower(r)
+	}
+
+	start, end, p := -1, -1, 0
+	for i, r := range text {
+		if fold(r) == pattern[p] {
+			if start < 0 {
+				start = i
+			}
+			if p++; p == len(pattern) {
+				end = i + 1
+				break
+			}
+		}
+	}
+	if end < 0 {
+		return 0, nil, false
+	}
+	p = len(pattern) - 1
+	for i := end - 1; i >= start; i-- {
+		if fold(text[i]) == pattern[p] {
+			if p--; p < 0 {
+				start = i
+				break
+			}
+		}
+	}
+
+	score, consecutive, firstBonus, inGap := 0, 0, 0, false
+	prev := charNonWord
+	if start > 0 {
+		prev = classOf(text[start-1])
+	}
+	positions := make([]int, 0, len(pattern))
+	p = 0
+	for i := start; i < end; i++ {
+		class := classOf(text[i])
+		if p < len(pattern) && fold(text[i]) == pattern[p] {
+			positions = append(positions, i)
+			score += fuzzyScoreMatch
+			bonus := bonusAt(prev, class)
+			if consecutive == 0 {
+				firstBonus = bonus
+			} else {
+				// a boundary starts a new chunk of consecutive matches
+				if bonus >= fuzzyBonusBoundary && bonus > firstBonus {
+					firstBonus = bonus
+				}
+				bonus = maxInt(bonus, firstBonus, fuzzyBonusConsecutive)
+			}
+			if p == 0 {
+				bonus *= fuzzyFirstCharMultiplier
+			}
+			score += bonus
+			inGap, consecutive = false, consecutive+1
+			p++
+		} else {
+			if inGap {
+				score += fuzzyScoreGapExtension
+			} else {
+				score += fuzzyScoreGapStart
+			}
+			inGap, consecutive, firstBonus = true, 0, 0
+		}
+		prev = class
+	}
+	return score, positions, true
+}
+
+func maxInt(n int, rest ...int) int {
+	for _, m := range rest {
+		if m > n {
+			n = m
+		}
+	}
+	return n
+}
@@ -0,0 +1,63 @@
+/*
+ *
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFuzzyMatch(t *testing.T) {
+	score := func(text string, terms ...string) int {
+		s, _, ok := fuzzyMatchTerms(text, terms)
+		assert.True(t, ok, text)
+		return s
+	}
+
+	_, positions, ok := fuzzyMatchTerms("git commit --amend", []string{"gca"})
+	assert.True(t, ok)
+	assert.Equal(t, []int{0, 4, 13}, positions)
+	// the match is shortened from the end, the last a is preferred
+	_, positions, _ = fuzzyMatchTerms("aab", []string{"ab"})
+	assert.Equal(t, []int{1, 2}, positions)
+	_, positions, _ = fuzzyMatchTerms("kubectl rollout status", []string{"status", "kub"})
+	assert.Equal(t, []int{0, 1, 2, 16, 17, 18, 19, 20, 21}, positions)
+
+	_, _, ok = fuzzyMatchTerms("git push", []string{"gpl"})
+	assert.False(t, ok)
+	_, _, ok = fuzzyMatchTerms("git push", []string{"git", "pull"})
+	assert.False(t, ok)
+	// upper case makes a term case sensitive
+	_, _, ok = fuzzyMatchTerms("make Build", []string{"build"})
+	assert.True(t, ok)
+	_, _, ok = fuzzyMatchTerms("make build", []string{"Build"})
+	assert.False(t, ok)
+
+	// consecutive and word boundary matches score higher than scattered ones
+	assert.True(t, score("docker ps", "ps") > score("docker pull images", "ps"))
+	assert.True(t, score("git status", "gs") > score("gast", "gs"))
+	assert.True(t, score("kubectl get pods", "kgp") > score("kubectlgetpods", "kgp"))
+}
+
+func TestSubsequencePattern(t *testing.T) {
+	assert.Equal(t, "%l%s%", subsequencePattern("ls"))
+	assert.Equal(t, `%5%\%%`, subsequencePattern("5%"))
+	assert.Equal(t, `%a%\_%\\%`, subsequencePattern(`a_\`))
+}
@@ -0,0 +1,105 @@
+/*
+ *
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// readyTimeout bounds the readiness checks so a hung db fails the probe
+// instead of hanging it.
+const readyTimeout = 2 * time.Second
+
+var started = time.Now()
+
+// healthz reports that the process is up and serving. It doesn't touch the db,
+// so a failing db doesn't get a healthy process restarted.
+func healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// readyz reports whether requests can be served: the db is reachable, its
+// tables are migrated and the jwt secret is loaded. Failures are logged, the
+// response only says which check failed.
+func readyz(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), readyTimeout)
+	defer cancel()
+
+	status, checks := http.StatusOK, gin.H{}
+	check := func(name string, err error) {
+		if err != nil {
+			ctxLog(ctx).WithError(err).Warnf("readiness check %v failed", name)
+			status, checks[name] = http.StatusServiceUnavailable, "failed"
+			return
+		}
+		checks[name] = "ok"
+	}
+	check("db", db.PingContext(ctx))
+	check("migrations", dbMigrated(ctx))
+	var err error
+	if config.Secret == "" {
+		err = errors.New("jwt secret not loaded")
+	}
+	check("secret", err)
+
+	result := "ok"
+	if status != http.StatusOK {
+		result = "unavailable"
+	}
+	c.JSON(status, gin.H{"status": result, "checks": checks})
+}
+
+// debugInfo reports the build, db and connection pool for admins.
+func debugInfo(opts Options) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rows, err := dbRowCounts(c.Request.Context())
+		if err != nil {
+			respondDBError(c, err)
+			return
+		}
+		stats := db.Stats()
+		c.IndentedJSON(http.StatusOK, gin.H{
+			"version":   opts.Version,
+			"gitCommit": opts.GitCommit,
+			"buildDate": opts.BuildDate,
+			"goVersion": runtime.Version(),
+			"uptime":    time.Since(started).Round(time.Second).String(),
+			"db": gin.H{
+				"dialect": dbDialect(),
+				"rows":    rows,
+				"pool": gin.H{
+					"maxOpenConnections": stats.MaxOpenConnections,
+					"openConnections":    stats.OpenConnections,
+					"inUse":              stats.InUse,
+					"idle":               stats.Idle,
+					"waitCount":          stats.WaitCount,
+					"waitDuration":       stats.WaitDuration.String(),
+					"maxIdleClosed":      stats.MaxIdleClosed,
+					"maxLifetimeClosed":  stats.MaxLifetimeClosed,
+				},
+			},
+		})
+	}
+}
@@ -0,0 +1,181 @@
+/*
+ *
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAPConfig configures authentication against an LDAP directory. Directory
+// authentication is disabled when URL is empty.
+type LDAPConfig struct {
+	// URL of the directory, e.g. ldaps://ldap.example.com:636
+	URL string
+	// BindDN and BindPassword are used to search for users. Searches are
+	// anonymous when BindDN is empty.
+	BindDN       string
+	BindPassword string
+	// BaseDN is the search base for users and groups.
+	BaseDN string
+	// UserFilter finds a user's entry. %s is replaced with the escaped username.
+	UserFilter string
+	// GroupFilter, if set, must match at least one entry for the user to be
+	// allowed in. %s is replaced with the escaped user DN.
+	GroupFilter string
+	// BreakGlass are the local accounts that may log in with their local
+	// password while the directory is unreachable.
+	BreakGlass []string
+	// LinkLocal lets a directory user log in to a local account with the same
+	// username, e.g. one registered before LDAP was enabled. Without it such
+	// logins are refused, so a directory entry can't take over a local account.
+	LinkLocal bool
+}
+
+// ldapTimeout bounds connecting to the directory and each request made on it.
+const ldapTimeout = 10 * time.Second
+
+var (
+	errLDAPNoUser       = errors.New("ldap: user not found")
+	errLDAPUnreachable  = errors.New("ldap: directory unreachable")
+	errLDAPUserConflict = errors.New("username is already taken by a local account, an admin can link it with --ldap-link-local")
+)
+
+// breakGlass reports whether username is one of the BreakGlass accounts.
+func (conf LDAPConfig) breakGlass(username string) bool {
+	for _, u := range conf.BreakGlass {
+		if u == username {
+			return true
+		}
+	}
+	return false
+}
+
+// localFallback reports whether a login the directory didn't accept, failing
+// with err, may be checked against local accounts. Only break glass accounts
+// get a local login, and only when the directory doesn't know them or is down,
+// never after it rejected a password or a group filter.
+func (conf LDAPConfig) localFallback(username string, err error) bool {
+	if err != errLDAPNoUser && !errors.Is(err, errLDAPUnreachable) {
+		return false
+	}
+	return conf.breakGlass(username)
+}
+
+// unreachable marks network failures, including timeouts, as errLDAPUnreachable.
+func unreachable(err error) error {
+	if ldap.IsErrorWithCode(err, ldap.ErrorNetwork) {
+		return fmt.Errorf("%w: %v", errLDAPUnreachable, err)
+	}
+	return err
+}
+
+// connect dials the directory and binds as BindDN when it's set.
+func (conf LDAPConfig) connect() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(conf.URL, ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errLDAPUnreachable, err)
+	}
+	conn.SetTimeout(ldapTimeout)
+	if conf.BindDN != "" {
+		if err := conn.Bind(conf.BindDN, conf.BindPassword); err != nil {
+			conn.Close()
+			return nil, unreachable(fmt.Errorf("ldap: service bind failed: %w", err))
+		}
+	}
+	return conn, nil
+}
+
+// find returns username's entry, or errLDAPNoUser when there isn't exactly one.
+func (conf LDAPConfig) find(conn *ldap.Conn, username string) (*ldap.Entry, error) {
+	filter := conf.UserFilter
+	if filter == "" {
+		filter = "(uid=%s)"
+	}
+	res, err := conn.Search(ldap.NewSearchRequest(
+		conf.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 10, false,
+		strings.Replace(filter, "%s", ldap.EscapeFilter(username), -1),
+		[]string{"dn", "mail"}, nil,
+	))
+	if err != nil {
+		return nil, unreachable(err)
+	}
+	if len(res.Entries) != 1 {
+		return nil, errLDAPNoUser
+	}
+	return res.Entries[0], nil
+}
+
+// userExists reports whether the directory has an entry for username, so
+// local accounts can't be registered ahead of directory users.
+func (conf LDAPConfig) userExists(username string) (bool, error) {
+	conn, err := conf.connect()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	_, err = conf.find(conn, username)
+	if err == errLDAPNoUser {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// authenticate looks up username in the directory, binds as it with password
+// and checks group membership. It returns the user's email address if the
+// directory has one.
+func (conf LDAPConfig) authenticate(username string, password string) (string, error) {
+	if username == "" || password == "" {
+		return "", errLDAPNoUser
+	}
+	conn, err := conf.connect()
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	entry, err := conf.find(conn, username)
+	if err != nil {
+		return "", err
+	}
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		return "", unreachable(err)
+	}
+
+	if conf.GroupFilter != "" {
+		res, err := conn.Search(ldap.NewSearchRequest(
+			conf.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 10, false,
+			strings.Replace(conf.GroupFilter, "%s", ldap.EscapeFilter(entry.DN), -1),
+			[]string{"dn"}, nil,
+		))
+		if err != nil {
+			return "", unreachable(err)
+		}
+		if len(res.Entries) == 0 {
+			return "", fmt.Errorf("ldap: %v is not in an allowed group", username)
+		}
+	}
+	return entry.GetAttributeValue("mail"), nil
+}
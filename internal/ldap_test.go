@@ -0,0 +1,281 @@
+/*
+ *
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testLDAPBaseDN   = "dc=example,dc=com"
+	testLDAPAdminDN  = "cn=admin,dc=example,dc=com"
+	testLDAPAdminPwd = "admin"
+)
+
+type testLDAPUser struct {
+	dn       string
+	password string
+	mail     string
+	member   bool
+}
+
+// testLDAPServer is an in-process LDAP directory that understands just enough
+// of the protocol for simple binds and the user and group searches.
+type testLDAPServer struct {
+	net.Listener
+	users map[string]testLDAPUser
+}
+
+func newTestLDAPServer() *testLDAPServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	check(err)
+	s := &testLDAPServer{
+		Listener: l,
+		users: map[string]testLDAPUser{
+			"ldap-user":     {dn: "uid=ldap-user,ou=people," + testLDAPBaseDN, password: "ldap-pass", mail: "ldap-user@example.com", member: true},
+			"ldap-outsider": {dn: "uid=ldap-outsider,ou=people," + testLDAPBaseDN, password: "outsider-pass"},
+			"ldap-local":    {dn: "uid=ldap-local,ou=people," + testLDAPBaseDN, password: "ldap-pass", member: true},
+		},
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func ldapTestConfig(s *testLDAPServer) LDAPConfig {
+	return LDAPConfig{
+		URL:          "ldap://" + s.Addr().String(),
+		BindDN:       testLDAPAdminDN,
+		BindPassword: testLDAPAdminPwd,
+		BaseDN:       testLDAPBaseDN,
+		UserFilter:   "(uid=%s)",
+		GroupFilter:  "(member=%s)",
+		// ldap-outsider is in the directory too
+		BreakGlass: []string{"breakglass", "ldap-outsider"},
+	}
+}
+
+func (s *testLDAPServer) bind(dn string, password string) bool {
+	if dn == testLDAPAdminDN {
+		return password == testLDAPAdminPwd
+	}
+	for _, u := range s.users {
+		if u.dn == dn {
+			return u.password == password
+		}
+	}
+	return false
+}
+
+func (s *testLDAPServer) search(filter string) map[string]string {
+	entries := make(map[string]string)
+	switch {
+	case strings.HasPrefix(filter, "(uid="):
+		if u, ok := s.users[strings.TrimSuffix(strings.TrimPrefix(filter, "(uid="), ")")]; ok {
+			entries[u.dn] = u.mail
+		}
+	case strings.HasPrefix(filter, "(member="):
+		dn := strings.TrimSuffix(strings.TrimPrefix(filter, "(member="), ")")
+		for _, u := range s.users {
+			if u.dn == dn && u.member {
+				entries["cn=bashhub,ou=groups,"+testLDAPBaseDN] = ""
+			}
+		}
+	}
+	return entries
+}
+
+func ldapEnvelope(id int64, op *ber.Packet) []byte {
+	p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	p.AppendChild(op)
+	return p.Bytes()
+}
+
+func ldapResult(tag ber.Tag, code uint16) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return op
+}
+
+func ldapEntry(dn string, mail string) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, ""))
+	attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	if mail != "" {
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "mail", ""))
+		vals := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+		vals.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, mail, ""))
+		attr.AppendChild(vals)
+		attrs.AppendChild(attr)
+	}
+	op.AppendChild(attrs)
+	return op
+}
+
+func (s *testLDAPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		p, err := ber.ReadPacket(conn)
+		if err != nil || len(p.Children) < 2 {
+			return
+		}
+		id, _ := p.Children[0].Value.(int64)
+		op := p.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			code := uint16(ldap.LDAPResultInvalidCredentials)
+			dn, _ := op.Children[1].Value.(string)
+			if s.bind(dn, op.Children[2].Data.String()) {
+				code = ldap.LDAPResultSuccess
+			}
+			conn.Write(ldapEnvelope(id, ldapResult(ldap.ApplicationBindResponse, code)))
+		case ldap.ApplicationSearchRequest:
+			filter, err := ldap.DecompileFilter(op.Children[6])
+			check(err)
+			for dn, mail := range s.search(filter) {
+				conn.Write(ldapEnvelope(id, ldapEntry(dn, mail)))
+			}
+			conn.Write(ldapEnvelope(id, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)))
+		default:
+			return
+		}
+	}
+}
+
+func login(username string, password string) int {
+	payload, _ := json.Marshal(map[string]string{"username": username, "password": password})
+	w := testRequest("POST", "/api/v1/login", bytes.NewReader(payload))
+	return w.Code
+}
+
+func TestLDAPLogin(t *testing.T) {
+	defer useRouter(idpRouter)()
+	assert.Equal(t, 200, login("ldap-user", "ldap-pass"))
+	assert.Equal(t, 401, login("ldap-user", "wrong"))
+	assert.Equal(t, 401, login("ldap-outsider", "outsider-pass"))
+
+	var email string
+	err := db.QueryRow(`SELECT "email" FROM users WHERE "username" = $1`, "ldap-user").Scan(&email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "ldap-user@example.com", email)
+
+	// break glass accounts can be registered and log in locally
+	payload := `{"Username": "breakglass", "password": "secret", "email": "breakglass@example.com"}`
+	w := testRequest("POST", "/api/v1/user", strings.NewReader(payload))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, 200, login("breakglass", "secret"))
+
+	// other local accounts can't
+	payload = `{"Username": "ldap-former", "password": "secret", "email": "former@example.com"}`
+	w = testRequest("POST", "/api/v1/user", strings.NewReader(payload))
+	assert.Equal(t, 403, w.Code)
+	assert.Contains(t, w.Body.String(), errCodeForbidden)
+	assert.Equal(t, 401, login("ldap-former", "secret"))
+
+	// directory usernames can't be registered ahead of their first login
+	payload = `{"Username": "ldap-outsider", "password": "local-pass", "email": "outsider@example.com"}`
+	w = testRequest("POST", "/api/v1/user", strings.NewReader(payload))
+	assert.Equal(t, 409, w.Code)
+	assert.Equal(t, 401, login("ldap-outsider", "outsider-pass"))
+
+	// a local account from before ldap was enabled isn't taken over by the
+	// directory user with its username
+	_, err = User{Username: "ldap-local", Password: "local-pass", Email: "local@example.com"}.userCreate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 401, login("ldap-local", "local-pass"))
+	payload = `{"username": "ldap-local", "password": "ldap-pass"}`
+	w = testRequest("POST", "/api/v1/login", strings.NewReader(payload))
+	assert.Equal(t, 409, w.Code)
+	assert.Contains(t, w.Body.String(), errCodeConflict)
+
+	// unless an admin links them, which keeps its password
+	var id uint
+	err = db.QueryRow(`SELECT "id" FROM users WHERE "username" = $1`, "ldap-local").Scan(&id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	linked, err := ldapUserLink(context.Background(), "ldap-local", "", true)
+	assert.NoError(t, err)
+	assert.Equal(t, id, linked)
+	assert.Equal(t, 200, login("ldap-local", "ldap-pass"))
+	var password string
+	err = db.QueryRow(`SELECT "password" FROM users WHERE "username" = $1`, "ldap-local").Scan(&password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEqual(t, "", password)
+}
+
+func TestLDAPLocalFallback(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	conf := ldapTestConfig(ldapServer)
+	conf.BreakGlass = []string{"admin"}
+
+	_, err = conf.authenticate("ldap-user", "wrong")
+	assert.Error(t, err)
+	assert.False(t, conf.localFallback("ldap-user", err))
+	_, err = conf.authenticate("nobody", "pass")
+	assert.False(t, conf.localFallback("nobody", err))
+	_, err = conf.authenticate("admin", "pass")
+	assert.True(t, conf.localFallback("admin", err))
+
+	exists, err := conf.userExists("ldap-user")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	exists, err = conf.userExists("nobody")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	conf.URL = "ldap://" + l.Addr().String()
+	_, err = conf.authenticate("admin", "pass")
+	assert.True(t, errors.Is(err, errLDAPUnreachable))
+	assert.True(t, conf.localFallback("admin", err))
+	assert.False(t, conf.localFallback("ldap-user", err))
+	_, err = conf.userExists("ldap-user")
+	assert.True(t, errors.Is(err, errLDAPUnreachable))
+}
@@ -0,0 +1,262 @@
+/*
+ *
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Server is a bashhub-server instance that drains in-flight requests and
+// closes the db when it's shut down.
+type Server struct {
+	addr       string
+	timeout    time.Duration
+	http       *http.Server
+	metrics    *http.Server
+	onShutdown []func()
+
+	shutdownOnce sync.Once
+	shutdownErr  error
+	done         chan struct{}
+}
+
+// NewServer sets up the db and routes for opts.
+func NewServer(opts Options) (*Server, error) {
+	s := newServer(opts, setupRouter(opts))
+	if opts.MetricsAddr != "" {
+		addr := strings.TrimPrefix(opts.MetricsAddr, "http://")
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metricsHandler())
+		s.metrics = &http.Server{Addr: addr, Handler: mux}
+	}
+	if strings.HasPrefix(opts.Addr, "https://") || opts.TLSCert != "" {
+		conf, stop, err := tlsConfig(opts)
+		if err != nil {
+			return nil, err
+		}
+		s.http.TLSConfig = conf
+		s.RegisterOnShutdown(stop)
+	}
+	// streams and websockets never finish on their own
+	s.http.RegisterOnShutdown(commandHub.closeAll)
+	s.http.RegisterOnShutdown(searchSockets.closeAll)
+	s.RegisterOnShutdown(searchSockets.wait)
+	s.RegisterOnShutdown(func() {
+		if err := dbClose(); err != nil {
+			logger.WithError(err).Error("closing db")
+		}
+	})
+	return s, nil
+}
+
+func newServer(opts Options, handler http.Handler) *Server {
+	addr := strings.ReplaceAll(opts.Addr, "http://", "")
+	addr = strings.ReplaceAll(addr, "https://", "")
+	timeout := opts.ShutdownTimeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	return &Server{
+		addr:    addr,
+		timeout: timeout,
+		http:    &http.Server{Addr: addr, Handler: handler},
+		done:    make(chan struct{}),
+	}
+}
+
+// RegisterOnShutdown adds f to the functions run, in order, once in-flight
+// requests have drained.
+func (s *Server) RegisterOnShutdown(f func()) {
+	s.onShutdown = append(s.onShutdown, f)
+}
+
+// ListenAndServe listens on the server's address and serves until it's shut
+// down. A socket passed by systemd socket activation is used instead of the
+// address when there is one.
+func (s *Server) ListenAndServe() error {
+	ln, err := s.listen()
+	if err != nil {
+		return err
+	}
+	if s.metrics != nil {
+		metricsLn, err := net.Listen("tcp", s.metrics.Addr)
+		if err != nil {
+			ln.Close()
+			return err
+		}
+		go s.metrics.Serve(metricsLn)
+	}
+	return s.Serve(ln)
+}
+
+func (s *Server) listen() (net.Listener, error) {
+	ln, err := systemdListener()
+	if ln != nil || err != nil {
+		return ln, err
+	}
+	if strings.HasPrefix(s.addr, "unix://") {
+		return listenUnix(strings.TrimPrefix(s.addr, "unix://"))
+	}
+	return net.Listen("tcp", s.addr)
+}
+
+// listenUnix listens on a unix socket only its owner can connect to.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		conn, err := net.DialTimeout("unix", path, time.Second)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%v is in use by another server", path)
+		}
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, err
+		}
+		// left behind by a server that didn't shut down cleanly
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	// the socket is made in a directory only its owner can use and moved
+	// into place once it's only theirs, it'd take the umask's mode otherwise
+	tmp, err := ioutil.TempDir(filepath.Dir(path), ".bashhub-server-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	sock := filepath.Join(tmp, "sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		return nil, err
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err = os.Chmod(sock, 0600); err == nil {
+		err = os.Rename(sock, path)
+	}
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return unixListener{ln, path}, nil
+}
+
+// unixListener removes its socket when it's closed, from where it was moved to.
+type unixListener struct {
+	net.Listener
+	path string
+}
+
+func (l unixListener) Close() error {
+	err := l.Listener.Close()
+	if err := os.Remove(l.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return err
+}
+
+// listenFdsStart is the first file descriptor passed by systemd.
+var listenFdsStart = 3
+
+// systemdListener returns the socket passed by systemd socket activation, or
+// nil when the server wasn't socket activated.
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, nil
+	}
+	if fds > 1 {
+		logger.Warnf("systemd passed %v sockets, only the first is used", fds)
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	syscall.CloseOnExec(listenFdsStart)
+	f := os.NewFile(uintptr(listenFdsStart), "systemd")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// Serve serves requests on ln. After Shutdown is called it waits for the
+// shutdown to finish and returns its error.
+func (s *Server) Serve(ln net.Listener) error {
+	var err error
+	if s.http.TLSConfig != nil {
+		err = s.http.ServeTLS(ln, "", "")
+	} else {
+		err = s.http.Serve(ln)
+	}
+	if err != http.ErrServerClosed {
+		return err
+	}
+	<-s.done
+	return s.shutdownErr
+}
+
+// Shutdown stops accepting connections, waits for in-flight requests until ctx
+// is done and then runs the shutdown functions. Requests still running when
+// ctx is done have their connections closed first.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.shutdownOnce.Do(func() {
+		s.shutdownErr = s.http.Shutdown(ctx)
+		if s.shutdownErr != nil {
+			s.http.Close()
+		}
+		if s.metrics != nil {
+			s.metrics.Close()
+		}
+		for _, f := range s.onShutdown {
+			f()
+		}
+		close(s.done)
+	})
+	<-s.done
+	return s.shutdownErr
+}
+
+// Run serves until SIGINT or SIGTERM and then shuts down gracefully, giving
+// in-flight requests up to the shutdown timeout to finish.
+func (s *Server) Run() error {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		logger.Infof("received %v, shutting down", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+		defer cancel()
+		s.Shutdown(ctx)
+	}()
+	return s.ListenAndServe()
+}
@@ -0,0 +1,233 @@
+/*
+ *
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startTestServer serves a handler that blocks until release is closed.
+func startTestServer(t *testing.T, release chan struct{}) (*Server, string, chan error, chan struct{}) {
+	started := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	})
+	s := newServer(Options{}, mux)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(ln)
+	}()
+	return s, "http://" + ln.Addr().String(), served, started
+}
+
+func TestServerShutdown(t *testing.T) {
+	release := make(chan struct{})
+	s, u, served, started := startTestServer(t, release)
+	var order []string
+	s.RegisterOnShutdown(func() { order = append(order, "first") })
+	s.RegisterOnShutdown(func() { order = append(order, "second") })
+
+	code := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(u + "/slow")
+		if err != nil {
+			code <- 0
+			return
+		}
+		resp.Body.Close()
+		code <- resp.StatusCode
+	}()
+	<-started
+	time.AfterFunc(50*time.Millisecond, func() { close(release) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, s.Shutdown(ctx))
+	assert.Equal(t, 200, <-code)
+	assert.Equal(t, []string{"first", "second"}, order)
+	assert.NoError(t, <-served)
+
+	_, err := http.Get(u + "/slow")
+	assert.Error(t, err)
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	s, u, served, started := startTestServer(t, release)
+	failed := make(chan error, 1)
+	go func() {
+		_, err := http.Get(u + "/slow")
+		failed <- err
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, s.Shutdown(ctx))
+	assert.Equal(t, context.DeadlineExceeded, <-served)
+	// the request still running at the deadline is cut off
+	select {
+	case err := <-failed:
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection left open after the shutdown deadline")
+	}
+}
+
+func TestServerUnixSocket(t *testing.T) {
+	sock := filepath.Join(testDir, "bashhub.sock")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {})
+	s := newServer(Options{Addr: "unix://" + sock}, mux)
+	ln, err := s.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+
+	fi, err := os.Stat(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return net.Dial("unix", sock)
+		},
+	}}
+	resp, err := client.Get("http://unix/ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+
+	// a running server's socket is left alone
+	_, err = listenUnix(sock)
+	assert.Error(t, err)
+
+	assert.NoError(t, s.Shutdown(context.Background()))
+	_, err = os.Stat(sock)
+	assert.True(t, os.IsNotExist(err))
+
+	// one left behind by a server that crashed is replaced
+	stale, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	ln, err = listenUnix(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+}
+
+func TestListenUnixMode(t *testing.T) {
+	dir, err := ioutil.TempDir(testDir, "sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the socket is never created with the umask's mode
+	defer syscall.Umask(syscall.Umask(0))
+	sock := filepath.Join(dir, "bashhub.sock")
+	ln, err := listenUnix(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	assert.NotZero(t, fi.Mode()&os.ModeSocket)
+	entries, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(entries))
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	assert.NoError(t, ln.Close())
+	_, err = os.Stat(sock)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestServerSocketActivation(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	f, err := tcp.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// systemdListener takes ownership of the fd, like it would of one from systemd
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(start int) { listenFdsStart = start }(listenFdsStart)
+	listenFdsStart = fd
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "1")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {})
+	s := newServer(Options{Addr: "unix://" + filepath.Join(testDir, "unused.sock")}, mux)
+	ln, err := s.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, os.Getenv("LISTEN_FDS"))
+	go s.Serve(ln)
+	defer s.Shutdown(context.Background())
+
+	resp, err := http.Get("http://" + tcp.Addr().String() + "/ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+}
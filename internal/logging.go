@@ -0,0 +1,217 @@
+/*
+ *
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/appleboy/gin-jwt/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// LogFormats are the supported values of Options.LogFormat.
+var LogFormats = []string{"text", "logfmt", "json"}
+
+var (
+	logger = logrus.New()
+	// slowQuery is how long a query can take before it's logged as slow.
+	slowQuery = 500 * time.Millisecond
+
+	validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+	// probeRoutes are only logged at debug level unless they fail.
+	probeRoutes = map[string]bool{"/healthz": true, "/readyz": true}
+)
+
+// requestInfo identifies the request a log line belongs to. A pointer to it is
+// carried in the request's context so the db layer can log with it.
+type requestInfo struct {
+	id     string
+	route  string
+	userID uint
+}
+
+type requestInfoKey struct{}
+
+// logInit configures the logger from opts. --log files are rotated once they
+// reach LogMaxSize megabytes.
+func logInit(opts Options) {
+	switch {
+	case opts.Log == "/dev/null":
+		logger.SetOutput(ioutil.Discard)
+	case opts.Log != "":
+		logger.SetOutput(&lumberjack.Logger{
+			Filename:   opts.Log,
+			MaxSize:    opts.LogMaxSize,
+			MaxBackups: opts.LogMaxBackups,
+			MaxAge:     opts.LogMaxAge,
+		})
+	default:
+		logger.SetOutput(os.Stderr)
+	}
+
+	switch opts.LogFormat {
+	case "json":
+		logger.SetFormatter(&logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano})
+	case "logfmt":
+		logger.SetFormatter(&logrus.TextFormatter{DisableColors: true, FullTimestamp: true, TimestampFormat: time.RFC3339Nano})
+	default:
+		logger.SetFormatter(textFormatter{})
+	}
+
+	level := logrus.InfoLevel
+	if opts.LogLevel != "" {
+		var err error
+		level, err = logrus.ParseLevel(opts.LogLevel)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	logger.SetLevel(level)
+
+	if opts.SlowQuery != 0 {
+		slowQuery = opts.SlowQuery
+	}
+}
+
+// textFormatter writes the human readable [BASHHUB-SERVER] lines.
+type textFormatter struct{}
+
+func (textFormatter) Format(e *logrus.Entry) ([]byte, error) {
+	var b bytes.Buffer
+	timestamp := e.Time.Format("2006/01/02 - 15:04:05")
+	if status, ok := e.Data["status"]; ok {
+		ms, _ := e.Data["duration_ms"].(float64)
+		fmt.Fprintf(&b, "[BASHHUB-SERVER] %v | %3d | %13v | %15s | %-7s  %s | %v\n",
+			timestamp, status, time.Duration(ms*float64(time.Millisecond)),
+			e.Data["ip"], e.Data["method"], e.Data["path"], e.Data["request_id"])
+		return b.Bytes(), nil
+	}
+	fmt.Fprintf(&b, "[BASHHUB-SERVER] %v | %-5s | %v", timestamp, strings.ToUpper(e.Level.String()), e.Message)
+	keys := make([]string, 0, len(e.Data))
+	for k := range e.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %v=%q", k, fmt.Sprint(e.Data[k]))
+	}
+	b.WriteByte('\n')
+	return b.Bytes(), nil
+}
+
+// ctxLog returns a logger with the fields of the request ctx belongs to.
+func ctxLog(ctx context.Context) *logrus.Entry {
+	info, ok := ctx.Value(requestInfoKey{}).(*requestInfo)
+	if !ok {
+		return logrus.NewEntry(logger)
+	}
+	fields := logrus.Fields{"request_id": info.id, "route": info.route}
+	if info.userID != 0 {
+		fields["user_id"] = info.userID
+	}
+	return logger.WithFields(fields)
+}
+
+// requestLogger gives each request an id, taken from a well formed X-Request-ID
+// header when the client sends one, and logs the request once it's served.
+func requestLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		id := c.GetHeader("X-Request-ID")
+		if !validRequestID.MatchString(id) {
+			id = uuid.New().String()
+		}
+		c.Header("X-Request-ID", id)
+		info := &requestInfo{id: id, route: c.FullPath()}
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), requestInfoKey{}, info))
+
+		c.Next()
+
+		status := c.Writer.Status()
+		entry := ctxLog(c.Request.Context()).WithFields(logrus.Fields{
+			"status":      status,
+			"method":      c.Request.Method,
+			"path":        c.Request.URL.Path,
+			"ip":          c.ClientIP(),
+			"duration_ms": milliseconds(time.Since(start)),
+		})
+		if len(c.Errors) > 0 {
+			entry = entry.WithField("error", c.Errors.String())
+		}
+		switch {
+		case status >= 500:
+			entry.Error("request")
+		case status < 400 && probeRoutes[c.FullPath()]:
+			// orchestrators probe every few seconds, only failures are news
+			entry.Debug("request")
+		default:
+			entry.Info("request")
+		}
+	}
+}
+
+// requestUser adds the authenticated user to the request's log fields.
+func requestUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if info, ok := c.Request.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+			if id, ok := jwt.ExtractClaims(c)["user_id"].(float64); ok {
+				info.userID = uint(id)
+			}
+		}
+		c.Next()
+	}
+}
+
+// queryLog logs failed and slow queries, and every query at debug level.
+func queryLog(ctx context.Context, query string, d time.Duration, err error) {
+	if err == nil && d < slowQuery && !logger.IsLevelEnabled(logrus.DebugLevel) {
+		return
+	}
+	query = strings.Join(strings.Fields(query), " ")
+	if len(query) > 500 {
+		query = query[:500] + "..."
+	}
+	entry := ctxLog(ctx).WithFields(logrus.Fields{"query": query, "duration_ms": milliseconds(d)})
+	switch {
+	case err != nil && err != sql.ErrNoRows && err != context.Canceled:
+		entry.WithError(err).Error("query failed")
+	case d >= slowQuery:
+		entry.Warn("slow query")
+	default:
+		entry.Debug("query")
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return math.Round(float64(d)/float64(time.Microsecond)) / 1000
+}
@@ -0,0 +1,99 @@
+/*
+ *
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// captureLogs collects json log lines until the returned func is called.
+func captureLogs() (*bytes.Buffer, func()) {
+	var buf bytes.Buffer
+	out, formatter, slow := logger.Out, logger.Formatter, slowQuery
+	logger.SetOutput(&buf)
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	return &buf, func() {
+		logger.SetOutput(out)
+		logger.SetFormatter(formatter)
+		slowQuery = slow
+	}
+}
+
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var l map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &l); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, l)
+	}
+	return lines
+}
+
+func TestRequestLogging(t *testing.T) {
+	buf, restore := captureLogs()
+	defer restore()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/ping", nil)
+	req.Header.Set("X-Request-ID", "req-1")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, "req-1", w.Header().Get("X-Request-ID"))
+	lines := logLines(t, buf)
+	assert.Equal(t, 1, len(lines))
+	assert.Equal(t, "request", lines[0]["msg"])
+	assert.Equal(t, "req-1", lines[0]["request_id"])
+	assert.Equal(t, "/ping", lines[0]["route"])
+	assert.Equal(t, float64(200), lines[0]["status"])
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/ping", nil)
+	req.Header.Set("X-Request-ID", "bad id")
+	router.ServeHTTP(w, req)
+	assert.NotEqual(t, "bad id", w.Header().Get("X-Request-ID"))
+	assert.Equal(t, 36, len(w.Header().Get("X-Request-ID")))
+
+	// every query is slow, so each one is logged with the request it ran for
+	buf.Reset()
+	slowQuery = 0
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/login", strings.NewReader(`{"username": "nobody", "password": "x"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Request-ID", "req-2")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 401, w.Code)
+	queries := 0
+	for _, l := range logLines(t, buf) {
+		assert.Equal(t, "req-2", l["request_id"])
+		if l["msg"] == "slow query" {
+			queries++
+			assert.NotEmpty(t, l["query"])
+		}
+	}
+	assert.NotZero(t, queries)
+}
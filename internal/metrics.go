@@ -0,0 +1,156 @@
+/*
+ *
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+	metrics         = promauto.With(metricsRegistry)
+
+	httpRequests = metrics.NewCounterVec(prometheus.CounterOpts{
+		Name: "bashhub_http_requests_total",
+		Help: "HTTP requests by method, route and status code.",
+	}, []string{"method", "route", "code"})
+	httpDuration = metrics.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bashhub_http_request_duration_seconds",
+		Help:    "HTTP request latency by method and route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+	commandsInserted = metrics.NewCounterVec(prometheus.CounterOpts{
+		Name: "bashhub_commands_inserted_total",
+		Help: "Commands inserted by user and system.",
+	}, []string{"user", "system"})
+	commandsImported = metrics.NewCounterVec(prometheus.CounterOpts{
+		Name: "bashhub_commands_imported_total",
+		Help: "Commands imported by user.",
+	}, []string{"user"})
+	logins = metrics.NewCounterVec(prometheus.CounterOpts{
+		Name: "bashhub_logins_total",
+		Help: "Logins by method (password, ldap or oidc) and result (success or failure).",
+	}, []string{"method", "result"})
+	rateLimited = metrics.NewCounterVec(prometheus.CounterOpts{
+		Name: "bashhub_rate_limited_total",
+		Help: "Requests rejected by rate limits, by budget (write, search or login).",
+	}, []string{"budget"})
+	streamSubscribers = metrics.NewGauge(prometheus.GaugeOpts{
+		Name: "bashhub_stream_subscribers",
+		Help: "Open command streams.",
+	})
+	streamDropped = metrics.NewCounter(prometheus.CounterOpts{
+		Name: "bashhub_stream_dropped_total",
+		Help: "Commands not sent to streams that fell too far behind.",
+	})
+	dbDuration = metrics.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bashhub_db_query_duration_seconds",
+		Help:    "DB query latency by statement type.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"statement"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+	dbStat := func(name string, help string, stat func(sql.DBStats) int) {
+		metrics.NewGaugeFunc(prometheus.GaugeOpts{Name: name, Help: help}, func() float64 {
+			if db == nil {
+				return 0
+			}
+			return float64(stat(db.Stats()))
+		})
+	}
+	dbStat("bashhub_db_open_connections", "Open db connections, in use and idle.",
+		func(s sql.DBStats) int { return s.OpenConnections })
+	dbStat("bashhub_db_in_use_connections", "DB connections currently in use.",
+		func(s sql.DBStats) int { return s.InUse })
+	dbStat("bashhub_db_idle_connections", "Idle db connections.",
+		func(s sql.DBStats) int { return s.Idle })
+	dbStat("bashhub_db_max_open_connections", "Maximum number of open db connections.",
+		func(s sql.DBStats) int { return s.MaxOpenConnections })
+	metrics.NewCounterFunc(prometheus.CounterOpts{
+		Name: "bashhub_db_wait_total",
+		Help: "Times a query waited for a free db connection.",
+	}, func() float64 {
+		if db == nil {
+			return 0
+		}
+		return float64(db.Stats().WaitCount)
+	})
+}
+
+// metricsHandler serves the metrics in the prometheus text format.
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// metricsMiddleware counts and times requests by their route pattern, so
+// /api/v1/command/:path is one series however many commands there are.
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		httpRequests.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Inc()
+		httpDuration.WithLabelValues(c.Request.Method, route).Observe(time.Since(start).Seconds())
+	}
+}
+
+// loginObserve counts a login audit event.
+func loginObserve(event AuditEvent) {
+	method := event.Detail
+	if method == "" {
+		method = "password"
+	}
+	switch event.Type {
+	case auditLogin:
+		logins.WithLabelValues(method, "success").Inc()
+	case auditLoginFailed:
+		logins.WithLabelValues(method, "failure").Inc()
+	}
+}
+
+// queryObserve records the latency of query, labelled by its first keyword.
+func queryObserve(query string, d time.Duration) {
+	statement := "other"
+	if fields := strings.Fields(query); len(fields) > 0 {
+		statement = strings.ToLower(strings.TrimRight(fields[0], ";"))
+	}
+	switch statement {
+	case "select", "insert", "update", "delete", "with":
+	default:
+		statement = "other"
+	}
+	dbDuration.WithLabelValues(statement).Observe(d.Seconds())
+}
@@ -0,0 +1,464 @@
+/*
+ *
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/appleboy/gin-jwt/v2"
+	"github.com/gin-gonic/gin"
+)
+
+// OIDCConfig configures login through an external OpenID Connect identity provider.
+// Login through the provider is disabled when Issuer is empty.
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+}
+
+// oidcProvider holds the discovered endpoints and signing keys of an identity provider.
+type oidcProvider struct {
+	OIDCConfig
+	AuthorizationEndpoint       string `json:"authorization_endpoint"`
+	TokenEndpoint               string `json:"token_endpoint"`
+	DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+	JWKSURI                     string `json:"jwks_uri"`
+	DiscoveredIssuer            string `json:"issuer"`
+
+	client *http.Client
+	mu     sync.Mutex
+	keys   map[string]*rsa.PublicKey
+
+	discoveryMu  sync.Mutex
+	discovered   bool
+	discoveryErr error
+	discoveryAt  time.Time
+}
+
+// oidcRetryInterval is how long a failed discovery is returned to logins
+// before the provider is asked again.
+const oidcRetryInterval = 10 * time.Second
+
+// oidcToken is the token endpoint response, including the device flow error codes.
+type oidcToken struct {
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// oidcClaims are the id token claims used to provision and link users.
+type oidcClaims struct {
+	Issuer            string      `json:"iss"`
+	Subject           string      `json:"sub"`
+	Audience          interface{} `json:"aud"`
+	Expires           int64       `json:"exp"`
+	Nonce             string      `json:"nonce,omitempty"`
+	Email             string      `json:"email"`
+	EmailVerified     bool        `json:"email_verified"`
+	PreferredUsername string      `json:"preferred_username"`
+}
+
+var errOIDCUserConflict = errors.New("username is already taken by a local account")
+
+// newOIDCProvider returns a provider for conf. Its endpoints are discovered on
+// the first login so the server starts while the provider is down.
+func newOIDCProvider(conf OIDCConfig) *oidcProvider {
+	return &oidcProvider{
+		OIDCConfig: conf,
+		client:     &http.Client{Timeout: 30 * time.Second},
+		keys:       make(map[string]*rsa.PublicKey),
+	}
+}
+
+// discover fetches the provider's endpoints unless that has already succeeded.
+// A failure is remembered for oidcRetryInterval, after which the next login
+// tries again.
+func (p *oidcProvider) discover() error {
+	p.discoveryMu.Lock()
+	defer p.discoveryMu.Unlock()
+	if p.discovered {
+		return nil
+	}
+	if p.discoveryErr != nil && time.Since(p.discoveryAt) < oidcRetryInterval {
+		return p.discoveryErr
+	}
+	p.discoveryAt = time.Now()
+	p.discoveryErr = p.fetchDiscovery()
+	p.discovered = p.discoveryErr == nil
+	return p.discoveryErr
+}
+
+func (p *oidcProvider) fetchDiscovery() error {
+	u := strings.TrimSuffix(p.Issuer, "/") + "/.well-known/openid-configuration"
+	resp, err := p.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc discovery from %v returned %v", u, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(p); err != nil {
+		return err
+	}
+	if p.DiscoveredIssuer != p.Issuer {
+		return fmt.Errorf("oidc issuer mismatch: configured %v, discovered %v", p.Issuer, p.DiscoveredIssuer)
+	}
+	return nil
+}
+
+// authCodeURL returns the provider url that starts the authorization code flow,
+// binding the id token to nonce and the code to the PKCE verifier's challenge.
+func (p *oidcProvider) authCodeURL(state string, nonce string, verifier string) string {
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.ClientID)
+	v.Set("redirect_uri", p.RedirectURL)
+	v.Set("scope", "openid email profile")
+	v.Set("state", state)
+	v.Set("nonce", nonce)
+	v.Set("code_challenge", pkceChallenge(verifier))
+	v.Set("code_challenge_method", "S256")
+	return p.AuthorizationEndpoint + "?" + v.Encode()
+}
+
+// pkceChallenge is the S256 code challenge for verifier.
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (p *oidcProvider) postForm(u string, form url.Values, v interface{}) (int, error) {
+	form.Set("client_id", p.ClientID)
+	if p.ClientSecret != "" {
+		form.Set("client_secret", p.ClientSecret)
+	}
+	resp, err := p.client.PostForm(u, form)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(v)
+}
+
+// exchange trades a grant for an id token and returns its verified claims.
+// nonce is the one sent with the authorization request, or empty for the
+// device flow which doesn't use one.
+func (p *oidcProvider) exchange(form url.Values, nonce string) (oidcClaims, error) {
+	var tok oidcToken
+	code, err := p.postForm(p.TokenEndpoint, form, &tok)
+	if err != nil {
+		return oidcClaims{}, err
+	}
+	if tok.Error != "" {
+		return oidcClaims{}, oidcError(tok.Error)
+	}
+	if code != http.StatusOK || tok.IDToken == "" {
+		return oidcClaims{}, fmt.Errorf("oidc token endpoint returned %v without an id token", code)
+	}
+	return p.verify(tok.IDToken, nonce)
+}
+
+// oidcError is an OAuth error code returned by the provider, such as
+// authorization_pending during the device flow.
+type oidcError string
+
+func (e oidcError) Error() string {
+	return string(e)
+}
+
+// verify checks the RS256 signature, issuer, audience, expiry and, when nonce
+// isn't empty, the nonce of an id token.
+func (p *oidcProvider) verify(idToken string, nonce string) (oidcClaims, error) {
+	var claims oidcClaims
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return claims, errors.New("malformed id token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return claims, err
+	}
+	if header.Alg != "RS256" {
+		return claims, fmt.Errorf("unsupported id token algorithm %v", header.Alg)
+	}
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return claims, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, err
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig); err != nil {
+		return claims, err
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return claims, err
+	}
+	switch {
+	case claims.Issuer != p.Issuer:
+		return claims, errors.New("id token has wrong issuer")
+	case !claims.hasAudience(p.ClientID):
+		return claims, errors.New("id token has wrong audience")
+	case claims.Expires < time.Now().Unix():
+		return claims, errors.New("id token is expired")
+	case claims.Subject == "":
+		return claims, errors.New("id token has no subject")
+	case nonce != "" && claims.Nonce != nonce:
+		return claims, errors.New("id token has wrong nonce")
+	}
+	return claims, nil
+}
+
+func (c oidcClaims) hasAudience(clientID string) bool {
+	switch aud := c.Audience.(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, a := range aud {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// username picks the bashhub username for a newly provisioned user.
+func (c oidcClaims) username() string {
+	switch {
+	case c.PreferredUsername != "":
+		return c.PreferredUsername
+	case c.Email != "":
+		return strings.Split(c.Email, "@")[0]
+	default:
+		return c.Subject
+	}
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// key returns the signing key for kid, refreshing the key set when it's unknown.
+func (p *oidcProvider) key(kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	resp, err := p.client.Get(p.JWKSURI)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		p.keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("no signing key %v in %v", kid, p.JWKSURI)
+}
+
+// randomState returns a random value for the state, nonce and PKCE verifier.
+// Its 64 characters are within the 43 to 128 a PKCE verifier needs.
+func randomState() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// oidcLogin provisions or links the user for claims and responds with a bashhub JWT.
+func oidcLogin(c *gin.Context, mw *jwt.GinJWTMiddleware, claims oidcClaims, mac string) {
+	user, err := oidcUserLink(c.Request.Context(), claims)
+	if err == errOIDCUserConflict {
+		audit(c, AuditEvent{Type: auditLoginFailed, Username: claims.username(), Detail: "oidc"})
+		respondError(c, http.StatusConflict, errCodeConflict, err)
+		return
+	}
+	if err != nil {
+		respondDBError(c, err)
+		return
+	}
+	if mac != "" {
+		user.Mac = &mac
+		if user.SystemName, err = user.userGetSystemName(c.Request.Context()); err != nil {
+			respondDBError(c, err)
+			return
+		}
+	}
+	audit(c, AuditEvent{Type: auditLogin, Username: user.Username, UserId: user.ID, Detail: "oidc"})
+	token, expire, err := mw.TokenGenerator(&user)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, errCodeInternal, err)
+		return
+	}
+	mw.LoginResponse(c, http.StatusOK, token, expire)
+}
+
+// setOIDCCookie stores a value for the callback, marked secure when the login
+// came over tls.
+func setOIDCCookie(c *gin.Context, name string, value string) {
+	c.SetCookie(name, value, 600, "/api/v1/oidc", "", c.Request.TLS != nil, true)
+}
+
+// oidcRoutes registers the authorization code and device code login flows,
+// each limited by limit.
+func oidcRoutes(r *gin.Engine, mw *jwt.GinJWTMiddleware, p *oidcProvider, limit gin.HandlerFunc) {
+	discovered := func(c *gin.Context) {
+		if err := p.discover(); err != nil {
+			_ = c.Error(err)
+			c.Header("Retry-After", strconv.Itoa(int(oidcRetryInterval.Seconds())))
+			respondError(c, http.StatusServiceUnavailable, errCodeIDPUnavailable, errors.New("identity provider is unavailable"))
+		}
+	}
+
+	r.GET("/api/v1/oidc/login", limit, discovered, func(c *gin.Context) {
+		state, nonce, verifier := randomState(), randomState(), randomState()
+		setOIDCCookie(c, "oidc_state", state)
+		setOIDCCookie(c, "oidc_nonce", nonce)
+		setOIDCCookie(c, "oidc_verifier", verifier)
+		setOIDCCookie(c, "oidc_mac", c.Query("mac"))
+		c.Redirect(http.StatusFound, p.authCodeURL(state, nonce, verifier))
+	})
+
+	r.GET("/api/v1/oidc/callback", limit, discovered, func(c *gin.Context) {
+		state, err := c.Cookie("oidc_state")
+		if err != nil || state == "" || state != c.Query("state") {
+			respondError(c, http.StatusBadRequest, errCodeBadRequest, errors.New("invalid oidc state"))
+			return
+		}
+		nonce, _ := c.Cookie("oidc_nonce")
+		verifier, _ := c.Cookie("oidc_verifier")
+		if nonce == "" || verifier == "" {
+			respondError(c, http.StatusBadRequest, errCodeBadRequest, errors.New("invalid oidc state"))
+			return
+		}
+		if e := c.Query("error"); e != "" {
+			respondError(c, http.StatusUnauthorized, errCodeUnauthorized, oidcError(e))
+			return
+		}
+		claims, err := p.exchange(url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {c.Query("code")},
+			"redirect_uri":  {p.RedirectURL},
+			"code_verifier": {verifier},
+		}, nonce)
+		if err != nil {
+			respondError(c, http.StatusUnauthorized, errCodeUnauthorized, err)
+			return
+		}
+		mac, _ := c.Cookie("oidc_mac")
+		oidcLogin(c, mw, claims, mac)
+	})
+
+	r.POST("/api/v1/oidc/device", limit, discovered, func(c *gin.Context) {
+		if p.DeviceAuthorizationEndpoint == "" {
+			respondError(c, http.StatusNotImplemented, errCodeUnsupported, errors.New("identity provider does not support the device flow"))
+			return
+		}
+		var auth map[string]interface{}
+		code, err := p.postForm(p.DeviceAuthorizationEndpoint, url.Values{"scope": {"openid email profile"}}, &auth)
+		if err != nil {
+			respondError(c, http.StatusBadGateway, errCodeIDPUnavailable, err)
+			return
+		}
+		c.JSON(code, auth)
+	})
+
+	r.POST("/api/v1/oidc/device/token", limit, discovered, func(c *gin.Context) {
+		var req struct {
+			DeviceCode string `json:"device_code"`
+			Mac        string `json:"mac"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || req.DeviceCode == "" {
+			respondError(c, http.StatusBadRequest, errCodeBadRequest, errors.New("device_code required"))
+			return
+		}
+		claims, err := p.exchange(url.Values{
+			"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+			"device_code": {req.DeviceCode},
+		}, "")
+		if _, ok := err.(oidcError); ok {
+			// the provider's error, such as authorization_pending, is
+			// passed on for the client to poll again or give up
+			respondError(c, http.StatusBadRequest, errCodeBadRequest, err)
+			return
+		}
+		if err != nil {
+			respondError(c, http.StatusUnauthorized, errCodeUnauthorized, err)
+			return
+		}
+		oidcLogin(c, mw, claims, req.Mac)
+	})
+}
@@ -0,0 +1,309 @@
+/*
+ *
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testOIDCServer is a minimal stand-in identity provider supporting the
+// authorization code and device code flows.
+type testOIDCServer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu         sync.Mutex
+	claims     map[string]oidcClaims // pending grants by code or device code
+	challenges map[string]string     // PKCE challenges by code
+	devices    map[string]bool       // device code approvals
+	next       oidcClaims            // claims for the next grant
+}
+
+func newTestOIDCServer() *testOIDCServer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	check(err)
+	s := &testOIDCServer{
+		key:        key,
+		claims:     make(map[string]oidcClaims),
+		challenges: make(map[string]string),
+		devices:    make(map[string]bool),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                        s.URL,
+			"authorization_endpoint":        s.URL + "/authorize",
+			"token_endpoint":                s.URL + "/token",
+			"device_authorization_endpoint": s.URL + "/device",
+			"jwks_uri":                      s.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test",
+				"n":   base64.RawURLEncoding.EncodeToString(s.key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(s.key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" || q.Get("nonce") == "" {
+			http.Error(w, "pkce and nonce required", http.StatusBadRequest)
+			return
+		}
+		code := s.grant()
+		s.mu.Lock()
+		claims := s.claims[code]
+		claims.Nonce = q.Get("nonce")
+		s.claims[code] = claims
+		s.challenges[code] = q.Get("code_challenge")
+		s.mu.Unlock()
+		u := r.URL.Query().Get("redirect_uri") + "?" + url.Values{
+			"code":  {code},
+			"state": {r.URL.Query().Get("state")},
+		}.Encode()
+		http.Redirect(w, r, u, http.StatusFound)
+	})
+	mux.HandleFunc("/device", func(w http.ResponseWriter, r *http.Request) {
+		code := s.grant()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"device_code":      code,
+			"user_code":        code[:8],
+			"verification_uri": s.URL + "/activate",
+			"expires_in":       60,
+			"interval":         1,
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		r.ParseForm()
+		code := r.Form.Get("code")
+		if r.Form.Get("grant_type") != "authorization_code" {
+			code = r.Form.Get("device_code")
+			if _, ok := s.claims[code]; ok && !s.devices[code] {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": "authorization_pending"})
+				return
+			}
+		}
+		claims, ok := s.claims[code]
+		if challenge, pkce := s.challenges[code]; pkce && pkceChallenge(r.Form.Get("code_verifier")) != challenge {
+			ok = false
+		}
+		if !ok || r.Form.Get("client_secret") != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		delete(s.claims, code)
+		delete(s.challenges, code)
+		json.NewEncoder(w).Encode(map[string]string{"id_token": s.sign(claims)})
+	})
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+func (s *testOIDCServer) grant() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	code := randomState()
+	s.claims[code] = s.next
+	return code
+}
+
+func (s *testOIDCServer) approve(deviceCode string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.devices[deviceCode] = true
+}
+
+func (s *testOIDCServer) sign(claims oidcClaims) string {
+	claims.Issuer = s.URL
+	claims.Audience = "bashhub"
+	claims.Expires = time.Now().Add(time.Minute).Unix()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, sum[:])
+	check(err)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func oidcTestConfig(s *testOIDCServer) OIDCConfig {
+	return OIDCConfig{
+		Issuer:       s.URL,
+		ClientID:     "bashhub",
+		ClientSecret: "secret",
+		RedirectURL:  "http://localhost/api/v1/oidc/callback",
+	}
+}
+
+// oidcCodeLogin runs the authorization code flow and returns the response from the callback.
+// tamper, when not nil, can change the login cookies before they're sent back.
+func oidcCodeLogin(t *testing.T, tamper func(*http.Cookie)) *httptest.ResponseRecorder {
+	w := testRequest("GET", "/api/v1/oidc/login", nil)
+	assert.Equal(t, http.StatusFound, w.Code)
+	cookies := w.Result().Cookies()
+	if tamper != nil {
+		for _, c := range cookies {
+			tamper(c)
+		}
+	}
+
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", callback.RequestURI(), nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestOIDCLogin(t *testing.T) {
+	defer useRouter(idpRouter)()
+	oidcServer.next = oidcClaims{Subject: "oidc-1", PreferredUsername: "oidc-tester", Email: "oidc@example.com"}
+	w := oidcCodeLogin(t, nil)
+	assert.Equal(t, 200, w.Code)
+	j := make(map[string]string)
+	err := json.Unmarshal(w.Body.Bytes(), &j)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/v1/command/search", nil)
+	req.Header.Add("Authorization", "Bearer "+j["accessToken"])
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	// users are linked by subject, never by a matching username and email
+	oidcServer.next = oidcClaims{Subject: "oidc-2", PreferredUsername: "oidc-tester", Email: "oidc@example.com", EmailVerified: true}
+	w = oidcCodeLogin(t, nil)
+	assert.Equal(t, 409, w.Code)
+	assert.Contains(t, w.Body.String(), errCodeConflict)
+
+	oidcServer.next = oidcClaims{Subject: "oidc-1", PreferredUsername: "renamed"}
+	w = oidcCodeLogin(t, nil)
+	assert.Equal(t, 200, w.Code)
+
+	w = oidcCodeLogin(t, func(c *http.Cookie) {
+		if c.Name == "oidc_nonce" {
+			c.Value = randomState()
+		}
+	})
+	assert.Equal(t, 401, w.Code)
+	assert.Contains(t, w.Body.String(), "nonce")
+	assert.Contains(t, w.Body.String(), errCodeUnauthorized)
+
+	w = oidcCodeLogin(t, func(c *http.Cookie) {
+		if c.Name == "oidc_verifier" {
+			c.Value = randomState()
+		}
+	})
+	assert.Equal(t, 401, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid_grant")
+
+	w = testRequest("GET", "/api/v1/oidc/callback?code=foo&state=bar", nil)
+	assert.Equal(t, 400, w.Code)
+	assert.Contains(t, w.Body.String(), errCodeBadRequest)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/oidc/login", nil)
+	req.TLS = &tls.ConnectionState{}
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusFound, w.Code)
+	for _, c := range w.Result().Cookies() {
+		assert.True(t, c.Secure, c.Name)
+	}
+}
+
+func TestOIDCDiscovery(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	p := newOIDCProvider(OIDCConfig{Issuer: down.URL, ClientID: "bashhub"})
+	assert.Error(t, p.discover())
+	// a failure is remembered rather than retried on every login
+	down.Close()
+	p.discoveryAt = p.discoveryAt.Add(-oidcRetryInterval / 2)
+	err := p.discover()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "404")
+
+	p = newOIDCProvider(oidcTestConfig(oidcServer))
+	assert.NoError(t, p.discover())
+	assert.Equal(t, oidcServer.URL+"/token", p.TokenEndpoint)
+}
+
+func TestOIDCDeviceLogin(t *testing.T) {
+	defer useRouter(idpRouter)()
+	oidcServer.next = oidcClaims{Subject: "oidc-1", PreferredUsername: "oidc-tester"}
+	w := testRequest("POST", "/api/v1/oidc/device", nil)
+	assert.Equal(t, 200, w.Code)
+	var auth map[string]interface{}
+	err := json.Unmarshal(w.Body.Bytes(), &auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deviceCode := auth["device_code"].(string)
+	payload, _ := json.Marshal(map[string]string{"device_code": deviceCode})
+
+	w = testRequest("POST", "/api/v1/oidc/device/token", bytes.NewReader(payload))
+	assert.Equal(t, 400, w.Code)
+	var pending map[string]string
+	_ = json.Unmarshal(w.Body.Bytes(), &pending)
+	assert.Equal(t, map[string]string{"error": "authorization_pending", "errorCode": errCodeBadRequest}, pending)
+
+	oidcServer.approve(deviceCode)
+	w = testRequest("POST", "/api/v1/oidc/device/token", bytes.NewReader(payload))
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), "accessToken")
+}
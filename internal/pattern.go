@@ -0,0 +1,121 @@
+/*
+ *
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"sync"
+)
+
+const (
+	// maxPatternLength is the longest search pattern accepted.
+	maxPatternLength = 512
+	// maxPatternSize bounds the number of instructions a search pattern
+	// compiles to, which counted repetition such as (a|b){500} multiplies.
+	maxPatternSize = 2000
+	// patternCacheSize is how many compiled patterns searchPatterns keeps.
+	patternCacheSize = 256
+)
+
+// searchPatterns caches the patterns compiled by the sqlite regexp function,
+// which is otherwise called with the same pattern for every row.
+var searchPatterns = &patternCache{patterns: map[string]*regexp.Regexp{}}
+
+type patternCache struct {
+	mu       sync.Mutex
+	patterns map[string]*regexp.Regexp
+}
+
+// compile returns the compiled pattern, compiling it on first use. The cache
+// starts over once it's full, searches tend to repeat the latest patterns.
+func (p *patternCache) compile(pattern string) (*regexp.Regexp, error) {
+	p.mu.Lock()
+	re, ok := p.patterns[pattern]
+	p.mu.Unlock()
+	if ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	if len(p.patterns) >= patternCacheSize {
+		p.patterns = map[string]*regexp.Regexp{}
+	}
+	p.patterns[pattern] = re
+	p.mu.Unlock()
+	return re, nil
+}
+
+// sqliteRegexp implements the regexp function used by sqlite searches.
+func sqliteRegexp(pattern string, s string) (bool, error) {
+	re, err := searchPatterns.compile(pattern)
+	if err != nil {
+		return false, err
+	}
+	return re.MatchString(s), nil
+}
+
+// validatePattern rejects search patterns that are invalid or can take far
+// longer to match than their size suggests. Go's regexp, used with sqlite,
+// matches in linear time, but postgres backtracks and nested repetition such
+// as (a+)+ takes exponential time there.
+func validatePattern(pattern string) error {
+	if len(pattern) > maxPatternLength {
+		return fmt.Errorf("query is longer than %v characters", maxPatternLength)
+	}
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return fmt.Errorf("query is not a valid regular expression: %v", err)
+	}
+	if nestedRepeat(re, false) {
+		return errors.New("query nests repetition, as in (a+)+, which can take exponential time to match")
+	}
+	prog, err := syntax.Compile(re.Simplify())
+	if err != nil || len(prog.Inst) > maxPatternSize {
+		return errors.New("query is too complex, use fewer or smaller counted repetitions")
+	}
+	return nil
+}
+
+// nestedRepeat reports whether re repeats a sub-expression without bound
+// while that sub-expression can itself match a varying number of times, so
+// there are exponentially many ways to match a string that almost matches.
+func nestedRepeat(re *syntax.Regexp, inRepeat bool) bool {
+	unbounded, varies := false, false
+	switch re.Op {
+	case syntax.OpStar, syntax.OpPlus:
+		unbounded, varies = true, true
+	case syntax.OpRepeat:
+		unbounded, varies = re.Max == -1, re.Max != re.Min
+	}
+	if varies && inRepeat {
+		return true
+	}
+	for _, sub := range re.Sub {
+		if nestedRepeat(sub, inRepeat || unbounded) {
+			return true
+		}
+	}
+	return false
+}
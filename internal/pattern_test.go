@@ -0,0 +1,84 @@
+/*
+ *
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidatePattern(t *testing.T) {
+	for _, pattern := range []string{
+		"git",
+		"^git (push|pull)",
+		"docker.*run",
+		`ls -l\s+/tmp`,
+		"(ab)+",
+		"[0-9]{1,3}(\\.[0-9]{1,3}){3}",
+		"(a+){3}",
+	} {
+		assert.NoError(t, validatePattern(pattern), pattern)
+	}
+	for _, pattern := range []string{
+		"(a+)+",
+		"(.*a)*",
+		"(a|b*){2,}",
+		"((ab)*c)+",
+		"(a{1,3})+",
+		"^(ls",
+		"(?=lookahead)",
+		".{1000}.{1000}.{1000}",
+		strings.Repeat("a", maxPatternLength+1),
+	} {
+		assert.Error(t, validatePattern(pattern), pattern)
+	}
+}
+
+func TestPatternCache(t *testing.T) {
+	cache := &patternCache{patterns: map[string]*regexp.Regexp{}}
+	a, err := cache.compile("^git")
+	assert.NoError(t, err)
+	b, err := cache.compile("^git")
+	assert.NoError(t, err)
+	assert.True(t, a == b)
+	_, err = cache.compile("(")
+	assert.Error(t, err)
+	for i := 0; i < patternCacheSize+1; i++ {
+		_, _ = cache.compile(strings.Repeat("a", i+1))
+	}
+	assert.True(t, len(cache.patterns) <= patternCacheSize)
+
+	match, err := sqliteRegexp("^git (push|pull)", "git push origin")
+	assert.NoError(t, err)
+	assert.True(t, match)
+}
+
+func TestSearchTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	_, err := Command{Query: "git", Limit: 10}.commandGet(ctx)
+	assert.Error(t, err)
+	assert.Equal(t, context.DeadlineExceeded, ctx.Err())
+}
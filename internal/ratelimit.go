@@ -0,0 +1,201 @@
+/*
+ *
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/appleboy/gin-jwt/v2"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+)
+
+// RateLimit allows Requests requests Per period, in bursts of up to Requests.
+// The zero RateLimit is unlimited.
+type RateLimit struct {
+	Requests int
+	Per      time.Duration
+}
+
+// RateLimits are the budgets for write, search and login routes. Write and
+// Search are spent by each authenticated user and WriteIP and SearchIP by each
+// client ip, so users behind one address can be given more between them than
+// any one of them gets. Login is per client ip.
+type RateLimits struct {
+	Write    RateLimit
+	WriteIP  RateLimit
+	Search   RateLimit
+	SearchIP RateLimit
+	Login    RateLimit
+}
+
+// ParseRateLimit parses a RateLimit written as <requests>/<period>, where the
+// period is s, m, h or a duration such as 10s. "0" and "" are unlimited.
+func ParseRateLimit(s string) (RateLimit, error) {
+	if s == "" || s == "0" {
+		return RateLimit{}, nil
+	}
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return RateLimit{}, fmt.Errorf("rate limit %q isn't <requests>/<period>", s)
+	}
+	n, err := strconv.Atoi(parts[0])
+	if err != nil || n < 0 {
+		return RateLimit{}, fmt.Errorf("rate limit %q: requests must be a positive number", s)
+	}
+	per, err := time.ParseDuration(parts[1])
+	if err != nil {
+		per, err = time.ParseDuration("1" + parts[1])
+	}
+	if err != nil || per <= 0 {
+		return RateLimit{}, fmt.Errorf("rate limit %q: period must be s, m, h or a duration", s)
+	}
+	if n == 0 {
+		return RateLimit{}, nil
+	}
+	return RateLimit{Requests: n, Per: per}, nil
+}
+
+// limiter is a token bucket per client ip and per user for one budget.
+type limiter struct {
+	name string
+	ip   RateLimit
+	user RateLimit
+
+	mu         sync.Mutex
+	buckets    map[string]*bucket
+	swept      time.Time
+	sweepEvery time.Duration
+}
+
+type bucket struct {
+	*rate.Limiter
+	limit RateLimit
+	used  time.Time
+}
+
+// newLimiter returns nil when both ip and user are unlimited.
+func newLimiter(name string, ip, user RateLimit) *limiter {
+	if ip.Requests == 0 && user.Requests == 0 {
+		return nil
+	}
+	l := &limiter{name: name, ip: ip, user: user, buckets: map[string]*bucket{}}
+	for _, limit := range []RateLimit{ip, user} {
+		if limit.Requests != 0 && (l.sweepEvery == 0 || limit.Per < l.sweepEvery) {
+			l.sweepEvery = limit.Per
+		}
+	}
+	return l
+}
+
+// take takes a token from ip's bucket and, unless it's empty, user's. When
+// either is empty nothing is taken and take returns how long until they both
+// have a token again and which limit was exceeded.
+func (l *limiter) take(now time.Time, ip, user string) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	var wait time.Duration
+	var exceeded error
+	var reservations []*rate.Reservation
+	for _, b := range []struct {
+		kind, key string
+		limit     RateLimit
+	}{
+		{"ip", ip, l.ip},
+		{"user", user, l.user},
+	} {
+		if b.key == "" || b.limit.Requests == 0 {
+			continue
+		}
+		key := b.kind + ":" + b.key
+		bk, ok := l.buckets[key]
+		if !ok {
+			every := rate.Limit(float64(b.limit.Requests) / b.limit.Per.Seconds())
+			bk = &bucket{Limiter: rate.NewLimiter(every, b.limit.Requests), limit: b.limit}
+			l.buckets[key] = bk
+		}
+		bk.used = now
+		r := bk.ReserveN(now, 1)
+		if delay := r.DelayFrom(now); delay > wait {
+			wait = delay
+			exceeded = fmt.Errorf("%v rate limit of %v per %v per %v exceeded", l.name, b.limit.Requests, b.limit.Per, b.kind)
+		}
+		reservations = append(reservations, r)
+	}
+	if wait > 0 {
+		for _, r := range reservations {
+			r.CancelAt(now)
+		}
+	}
+	return wait, exceeded
+}
+
+// sweep forgets buckets that haven't been used for long enough to be full
+// again, so they're no different from a new one.
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < l.sweepEvery {
+		return
+	}
+	for key, b := range l.buckets {
+		if now.Sub(b.used) >= b.limit.Per {
+			delete(l.buckets, key)
+		}
+	}
+	l.swept = now
+}
+
+// rateLimit takes a token from l for the request and otherwise aborts with
+// 429 and when to retry.
+func rateLimit(l *limiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if l == nil {
+			return
+		}
+		if wait, err := l.takeFor(c); err != nil {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			respondError(c, http.StatusTooManyRequests, errCodeRateLimited, err)
+		}
+	}
+}
+
+// takeFor takes a token for the client ip and, when there is one, the
+// authenticated user, so neither many users behind one ip nor one user from
+// many ips gets more than their budget. When it can't it returns how long
+// until there are tokens again and which limit was exceeded.
+func (l *limiter) takeFor(c *gin.Context) (time.Duration, error) {
+	var user string
+	switch id := jwt.ExtractClaims(c)["user_id"].(type) {
+	case float64:
+		user = fmt.Sprint(uint(id))
+	case uint:
+		user = fmt.Sprint(id)
+	}
+	wait, err := l.take(time.Now(), c.ClientIP(), user)
+	if err != nil {
+		rateLimited.WithLabelValues(l.name).Inc()
+	}
+	return wait, err
+}
@@ -0,0 +1,167 @@
+/*
+ *
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/appleboy/gin-jwt/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	for s, want := range map[string]RateLimit{
+		"":       {},
+		"0":      {},
+		"0/s":    {},
+		"10/s":   {Requests: 10, Per: time.Second},
+		"600/m":  {Requests: 600, Per: time.Minute},
+		"5/h":    {Requests: 5, Per: time.Hour},
+		"20/10s": {Requests: 20, Per: 10 * time.Second},
+	} {
+		limit, err := ParseRateLimit(s)
+		assert.NoError(t, err, s)
+		assert.Equal(t, want, limit, s)
+	}
+	for _, s := range []string{"10", "x/s", "-1/s", "10/d", "10/0s", "10/-1s"} {
+		_, err := ParseRateLimit(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter("test", RateLimit{Requests: 2, Per: time.Second}, RateLimit{})
+	now := time.Now()
+	take := func(now time.Time, ip, user string) time.Duration {
+		wait, err := l.take(now, ip, user)
+		assert.Equal(t, wait > 0, err != nil)
+		return wait
+	}
+	assert.Zero(t, take(now, "a", ""))
+	assert.Zero(t, take(now, "a", ""))
+	assert.Equal(t, 500*time.Millisecond, take(now, "a", ""))
+	// a rejected request doesn't use up a token
+	assert.Equal(t, 500*time.Millisecond, take(now, "a", ""))
+	assert.Zero(t, take(now, "b", ""))
+	assert.Zero(t, take(now.Add(500*time.Millisecond), "a", ""))
+	// there's no user budget to spend
+	assert.Zero(t, take(now, "c", "1"))
+	assert.Zero(t, take(now, "d", "1"))
+
+	// idle buckets are full again, so they're forgotten
+	take(now.Add(1500*time.Millisecond), "e", "")
+	assert.Equal(t, 1, len(l.buckets))
+
+	// a token is only taken when both buckets have one
+	l = newLimiter("test", RateLimit{Requests: 2, Per: time.Second}, RateLimit{Requests: 1, Per: time.Second})
+	assert.Zero(t, take(now, "a", "1"))
+	assert.Equal(t, time.Second, take(now, "b", "1"))
+	_, err := l.take(now, "b", "1")
+	assert.EqualError(t, err, "test rate limit of 1 per 1s per user exceeded")
+	assert.Zero(t, take(now, "b", "2"))
+	assert.Zero(t, take(now, "b", ""))
+	_, err = l.take(now, "b", "3")
+	assert.EqualError(t, err, "test rate limit of 2 per 1s per ip exceeded")
+
+	assert.Nil(t, newLimiter("test", RateLimit{}, RateLimit{}))
+}
+
+func TestRateLimit(t *testing.T) {
+	r := newEngine(nil)
+	r.GET("/", rateLimit(newLimiter("test", RateLimit{Requests: 1, Per: time.Minute}, RateLimit{Requests: 1, Per: time.Minute})), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	request := func(ip string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = ip + ":1234"
+		r.ServeHTTP(w, req)
+		return w
+	}
+	assert.Equal(t, 200, request("10.0.0.1").Code)
+	w := request("10.0.0.1")
+	assert.Equal(t, 429, w.Code)
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), errCodeRateLimited)
+	assert.Equal(t, 200, request("10.0.0.2").Code)
+
+	r = newEngine(nil)
+	r.GET("/", func(c *gin.Context) {
+		id, _ := strconv.Atoi(c.Query("user"))
+		c.Set("JWT_PAYLOAD", jwt.MapClaims{"user_id": float64(id)})
+	}, rateLimit(newLimiter("test", RateLimit{Requests: 1, Per: time.Minute}, RateLimit{Requests: 1, Per: time.Minute})), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	userRequest := func(ip string, user int) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/?user=%v", user), nil)
+		req.RemoteAddr = ip + ":1234"
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	assert.Equal(t, 200, userRequest("10.0.0.1", 1))
+	// users share their ip's budget and keep their own from any ip
+	assert.Equal(t, 429, userRequest("10.0.0.1", 2))
+	assert.Equal(t, 429, userRequest("10.0.0.2", 1))
+	assert.Equal(t, 200, userRequest("10.0.0.3", 3))
+
+	// users behind one ip can share a larger ip budget than they each get
+	r = newEngine(nil)
+	r.GET("/", func(c *gin.Context) {
+		id, _ := strconv.Atoi(c.Query("user"))
+		c.Set("JWT_PAYLOAD", jwt.MapClaims{"user_id": float64(id)})
+	}, rateLimit(newLimiter("test", RateLimit{Requests: 2, Per: time.Minute}, RateLimit{Requests: 1, Per: time.Minute})), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	assert.Equal(t, 200, userRequest("10.0.0.1", 1))
+	assert.Equal(t, 429, userRequest("10.0.0.1", 1))
+	assert.Equal(t, 200, userRequest("10.0.0.1", 2))
+	assert.Equal(t, 429, userRequest("10.0.0.1", 3))
+}
+
+func TestRateLimitForwardedFor(t *testing.T) {
+	request := func(r *gin.Engine, forwardedFor string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	handler := func(c *gin.Context) { c.Status(http.StatusOK) }
+
+	// a spoofed X-Forwarded-For doesn't get a new bucket
+	r := newEngine(nil)
+	r.GET("/", rateLimit(newLimiter("test", RateLimit{Requests: 1, Per: time.Minute}, RateLimit{Requests: 1, Per: time.Minute})), handler)
+	assert.Equal(t, 200, request(r, "192.168.0.1"))
+	assert.Equal(t, 429, request(r, "192.168.0.2"))
+
+	// unless it comes from a trusted proxy
+	r = newEngine([]string{"10.0.0.0/8"})
+	r.GET("/", rateLimit(newLimiter("test", RateLimit{Requests: 1, Per: time.Minute}, RateLimit{Requests: 1, Per: time.Minute})), handler)
+	assert.Equal(t, 200, request(r, "192.168.0.1"))
+	assert.Equal(t, 200, request(r, "192.168.0.2"))
+	assert.Equal(t, 429, request(r, "192.168.0.1"))
+}
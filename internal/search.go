@@ -0,0 +1,100 @@
+/*
+ *
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// searchParams are how a search is made, beyond the filters in its Command.
+type searchParams struct {
+	Mode    string
+	Sort    string
+	Here    frecencyContext
+	Verbose bool
+	// Username is set on verbose results.
+	Username string
+}
+
+// validate returns the status, error code and error a search with p and
+// cmd's query gets without running, or a zero status when it can run.
+func (p searchParams) validate(cmd Command) (int, string, error) {
+	switch p.Mode {
+	case "regex":
+		if cmd.Query != "" {
+			if err := validatePattern(cmd.Query); err != nil {
+				return http.StatusBadRequest, errCodeBadRequest, err
+			}
+		}
+	case "fts":
+		if ftsUnavailable != nil {
+			return http.StatusNotImplemented, errCodeNoFTS,
+				errors.New("full text search isn't available on this server")
+		}
+	case "fuzzy":
+	default:
+		return http.StatusBadRequest, errCodeBadRequest,
+			fmt.Errorf("mode must be regex, fts or fuzzy, not %q", p.Mode)
+	}
+	switch {
+	case p.Sort == "frecency" && p.Mode != "regex":
+		return http.StatusBadRequest, errCodeBadRequest,
+			fmt.Errorf("sort=frecency can't be used with mode=%v", p.Mode)
+	case p.Sort != "created" && p.Sort != "frecency":
+		return http.StatusBadRequest, errCodeBadRequest,
+			fmt.Errorf("sort must be created or frecency, not %q", p.Sort)
+	}
+	return 0, "", nil
+}
+
+// search runs cmd's search the way p says. truncated is set when a fuzzy
+// search had more candidates than it scores.
+func (cmd Command) search(ctx context.Context, p searchParams) (result []Query, truncated bool, err error) {
+	switch {
+	case p.Sort == "frecency":
+		result, err = cmd.commandGetFrecent(ctx, time.Now().UnixNano()/int64(time.Millisecond), p.Here)
+	case p.Mode == "fts" && cmd.Query != "":
+		result, err = cmd.commandSearchFTS(ctx)
+	case p.Mode == "fuzzy" && cmd.Query != "":
+		result, truncated, err = cmd.commandSearchFuzzy(ctx)
+	default:
+		result, err = cmd.commandGet(ctx)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if p.Verbose {
+		if err := cmd.commandFill(ctx, result); err != nil {
+			return nil, false, err
+		}
+		for i := range result {
+			result[i].Username = p.Username
+		}
+	}
+	return result, truncated, nil
+}
+
+// searchTimedOut is the error for a search cancelled by the search timeout.
+func searchTimedOut(timeout time.Duration) error {
+	return fmt.Errorf("search took longer than %v, try a more specific query", timeout)
+}
@@ -19,12 +19,14 @@
 package internal
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -41,6 +43,8 @@ type User struct {
 	Mac              *string `json:"mac" gorm:"-"`
 	RegistrationCode *string `json:"registrationCode"`
 	SystemName       string  `json:"systemName" gorm:"-"`
+	OIDCSubject      *string `json:"-" gorm:"column:oidc_subject"`
+	LDAPLinked       bool    `json:"-" gorm:"column:ldap_linked;not null;default:false"`
 }
 
 type Query struct {
@@ -52,6 +56,17 @@ type Query struct {
 	Username   string  `json:"username"`
 	SystemName string  `gorm:"-"  json:"systemName"`
 	SessionID  *string `json:"sessionId"`
+	// Score and Positions, the rune offsets of the matched characters, are
+	// set by fuzzy searches.
+	Score     int   `json:"score,omitempty" gorm:"-"`
+	Positions []int `json:"positions,omitempty" gorm:"-"`
+	// Count, how many times the command was run, and FirstSeen, when it was
+	// first run, are set by unique searches.
+	Count     int   `json:"count,omitempty" gorm:"-"`
+	FirstSeen int64 `json:"firstSeen,omitempty" gorm:"-"`
+	StartTime int64 `json:"startTime,omitempty"`
+	EndTime   int64 `json:"endTime,omitempty"`
+	Duration  int64 `json:"durationMs,omitempty"`
 }
 
 type Command struct {
@@ -69,6 +84,13 @@ type Command struct {
 	Unique           bool   `gorm:"-"`
 	Query            string `gorm:"-"`
 	SessionID        string `json:"sessionId"`
+	// StartTime and EndTime are when the command started and finished, and
+	// Duration how long it ran, in milliseconds. They're optional.
+	StartTime int64 `json:"startTime"`
+	EndTime   int64 `json:"endTime"`
+	Duration  int64 `json:"durationMs" gorm:"column:duration"`
+	// MinDuration only matches commands that ran at least this long.
+	MinDuration int64 `gorm:"-"`
 }
 
 type System struct {
@@ -94,6 +116,19 @@ type Status struct {
 	SessionName          string `json:"sessionName"`
 	SessionStartTime     int64  `json:"sessionStartTime"`
 	SessionTotalCommands int    `json:"sessionTotalCommands"`
+	// The system's stats are for the system the status is asked from.
+	SystemName          string `json:"systemName"`
+	SystemTotalCommands int    `json:"systemTotalCommands"`
+	SystemTotalSessions int    `json:"systemTotalSessions"`
+	// Today is the server's day.
+	TopCommandsToday    []CommandCount `json:"topCommandsToday"`
+	MostActivePathToday string         `json:"mostActivePathToday"`
+}
+
+// CommandCount is how many times a command was run.
+type CommandCount struct {
+	Command string `json:"command"`
+	Count   int    `json:"count"`
 }
 
 type Config struct {
@@ -102,55 +137,225 @@ type Config struct {
 	Created time.Time
 }
 
+// Import is a command from another server's history. POST /api/v1/import
+// takes one, or an array of up to maxImportBatch.
 type Import Query
 
+// maxImportBatch is the most commands one import request can carry.
+const maxImportBatch = 1000
+
+// APIKey is a long-lived, scoped credential that can be used in place of a JWT.
+type APIKey struct {
+	ID       uint   `json:"id" gorm:"primary_key"`
+	Name     string `json:"name"`
+	Scope    string `json:"scope"`
+	Prefix   string `json:"prefix"`
+	Hash     string `json:"-" gorm:"unique_index"`
+	Key      string `json:"key,omitempty" gorm:"-"`
+	Created  int64  `json:"created"`
+	LastUsed int64  `json:"lastUsed"`
+	User     User   `json:"-" gorm:"association_foreignkey:ID"`
+	UserId   uint   `json:"-"`
+}
+
+const (
+	// apiKeyPrefix marks a bearer token as an api key rather than a JWT.
+	apiKeyPrefix = "bh_"
+
+	scopeSearch = "search"
+	scopeImport = "import"
+	scopeAdmin  = "admin"
+)
+
+// Options configures the server started by Run.
+type Options struct {
+	DB           string
+	Log          string
+	Addr         string
+	Registration bool
+	OIDC         OIDCConfig
+	LDAP         LDAPConfig
+	// Admins are the usernames allowed to use admin endpoints.
+	Admins []string
+	// TLSCert and TLSKey enable https. TLSClientCA additionally lets clients
+	// authenticate with a certificate whose common name is their username.
+	TLSCert     string
+	TLSKey      string
+	TLSClientCA string
+	// ShutdownTimeout is how long in-flight requests are given to finish on
+	// shutdown. Defaults to 30 seconds.
+	ShutdownTimeout time.Duration
+	// MetricsAddr serves /metrics on its own address without authentication.
+	// When it's empty /metrics is served on Addr for admins only.
+	MetricsAddr string
+	// LogFormat is one of LogFormats, text by default. A Log file is rotated
+	// after LogMaxSize megabytes, keeping LogMaxBackups old files for at most
+	// LogMaxAge days.
+	LogFormat     string
+	LogLevel      string
+	LogMaxSize    int
+	LogMaxBackups int
+	LogMaxAge     int
+	// SlowQuery is how long a query can take before it's logged as slow.
+	SlowQuery time.Duration
+	// SearchTimeout cancels searches that take longer, 0 doesn't time out.
+	SearchTimeout time.Duration
+	// RateLimits are the per user and per ip budgets for write, search and
+	// login routes.
+	RateLimits RateLimits
+	// TrustedProxies are the addresses or cidrs of proxies whose
+	// X-Forwarded-For and X-Real-IP headers are believed. Requests from
+	// anywhere else are identified by their remote address.
+	TrustedProxies []string
+	// Version, GitCommit and BuildDate identify the build in /debug/info.
+	Version   string
+	GitCommit string
+	BuildDate string
+}
+
 var config Config
 
-func getLog(logFile string) io.Writer {
-	switch {
-	case logFile == "/dev/null":
-		return ioutil.Discard
-	case logFile != "":
-		f, err := os.Create(logFile)
+// authenticate accepts either an api key or a JWT from the Authorization bearer
+// token, the token query parameter or the jwt cookie, the same places the jwt
+// middleware looks, or a verified tls client certificate when there is none.
+// Api keys and certificates are resolved to the same claims a JWT carries so
+// handlers can keep using jwt.ExtractClaims.
+func authenticate(mw *jwt.GinJWTMiddleware) gin.HandlerFunc {
+	jwtAuth := mw.MiddlewareFunc()
+	return func(c *gin.Context) {
+		token := requestToken(c, mw)
+		if token == "" && c.Request.TLS != nil && len(c.Request.TLS.VerifiedChains) != 0 {
+			user := User{Username: c.Request.TLS.VerifiedChains[0][0].Subject.CommonName}
+			var err error
+			user.ID, err = user.userGetID(c.Request.Context())
+			if err != nil {
+				respondDBError(c, err)
+				return
+			}
+			if user.ID == 0 {
+				c.Abort()
+				mw.Unauthorized(c, http.StatusUnauthorized, "no user for client certificate")
+				return
+			}
+			c.Set("JWT_PAYLOAD", jwt.MapClaims{
+				"username":   user.Username,
+				"systemName": "",
+				"user_id":    float64(user.ID),
+			})
+			c.Next()
+			return
+		}
+		if !strings.HasPrefix(token, apiKeyPrefix) {
+			jwtAuth(c)
+			return
+		}
+		key, err := APIKey{Key: token}.apiKeyLookup(c.Request.Context())
+		if err == sql.ErrNoRows {
+			c.Abort()
+			mw.Unauthorized(c, http.StatusUnauthorized, "invalid api key")
+			return
+		}
 		if err != nil {
-			log.Fatal(err)
+			respondDBError(c, err)
+			return
 		}
-		return f
-	default:
-		return os.Stderr
+		c.Set("JWT_PAYLOAD", jwt.MapClaims{
+			"username":   key.User.Username,
+			"systemName": "",
+			"user_id":    float64(key.User.ID),
+			"scope":      key.Scope,
+		})
+		c.Next()
 	}
 }
 
-// loggerWithFormatterWriter instance a Logger middleware with the specified log format function.
-func loggerWithFormatterWriter(logFile string, f gin.LogFormatter) gin.HandlerFunc {
-	return gin.LoggerWithConfig(gin.LoggerConfig{
-		Formatter: f,
-		Output:    getLog(logFile),
-	})
+// requestToken returns the request's bearer token, token query parameter or
+// jwt cookie, whichever comes first, so browsers can use an api key for the
+// event stream and websocket as they can a JWT.
+func requestToken(c *gin.Context, mw *jwt.GinJWTMiddleware) string {
+	if auth := c.GetHeader("Authorization"); auth != "" {
+		return strings.TrimPrefix(auth, mw.TokenHeadName+" ")
+	}
+	if token := c.Query("token"); token != "" {
+		return token
+	}
+	token, _ := c.Cookie("jwt")
+	return token
+}
+
+// requireScope rejects api keys that weren't granted scope. JWTs carry no
+// scope claim and are allowed everything.
+func requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := jwt.ExtractClaims(c)
+		s, ok := claims["scope"].(string)
+		if !ok || s == scopeAdmin || s == scope {
+			c.Next()
+			return
+		}
+		respondError(c, http.StatusForbidden, errCodeForbidden, fmt.Errorf("api key requires %v scope", scope))
+	}
+}
+
+// bindImports reads an import request body, which is either one command or an
+// array of them.
+func bindImports(c *gin.Context) ([]Import, error) {
+	body, err := c.GetRawData()
+	if err != nil {
+		return nil, err
+	}
+	var imports []Import
+	if b := bytes.TrimSpace(body); len(b) != 0 && b[0] == '[' {
+		err = json.Unmarshal(b, &imports)
+	} else {
+		imports = make([]Import, 1)
+		err = json.Unmarshal(body, &imports[0])
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(imports) > maxImportBatch {
+		return nil, fmt.Errorf("can't import more than %v commands in one request", maxImportBatch)
+	}
+	return imports, nil
+}
+
+// newEngine returns a gin engine that only takes the client ip from headers
+// on requests from trustedProxies, so clients can't choose their own ip for
+// rate limits and the audit log.
+func newEngine(trustedProxies []string) *gin.Engine {
+	r := gin.New()
+	if err := r.SetTrustedProxies(trustedProxies); err != nil {
+		log.Fatal(err)
+	}
+	return r
+}
+
+// setupRouter opens the log and the database and returns the router for opts.
+func setupRouter(opts Options) *gin.Engine {
+	logInit(opts)
+	dbInit(opts.DB)
+	return newRouter(opts)
 }
 
 // configure routes and middleware
-func setupRouter(dbPath string, logFile string, registration bool) *gin.Engine {
-	dbInit(dbPath)
+func newRouter(opts Options) *gin.Engine {
 	gin.SetMode(gin.ReleaseMode)
-	r := gin.New()
+	r := newEngine(opts.TrustedProxies)
 	r.Use(gin.Recovery())
+	r.Use(requestLogger())
+	r.Use(metricsMiddleware())
 
-	r.Use(loggerWithFormatterWriter(logFile, func(param gin.LogFormatterParams) string {
-		return fmt.Sprintf("[BASHHUB-SERVER] %v | %3d | %13v | %15s | %-7s  %s\n",
-			param.TimeStamp.Format("2006/01/02 - 15:04:05"),
-			param.StatusCode,
-			param.Latency,
-			param.ClientIP,
-			param.Method,
-			param.Path,
-		)
-	}))
+	secret, err := config.getSecret()
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.Secret = secret
 
 	// the jwt middleware
 	authMiddleware, err := jwt.New(&jwt.GinJWTMiddleware{
 		Realm:       "bashhub-server zone",
-		Key:         []byte(config.getSecret()),
+		Key:         []byte(secret),
 		Timeout:     10000 * time.Hour,
 		MaxRefresh:  10000 * time.Hour,
 		IdentityKey: "username",
@@ -191,24 +396,84 @@ func setupRouter(dbPath string, logFile string, registration bool) *gin.Engine {
 			if err := c.ShouldBind(&user); err != nil {
 				return "", jwt.ErrMissingLoginValues
 			}
-			if user.userExists() {
+			if opts.LDAP.URL != "" {
+				email, err := opts.LDAP.authenticate(user.Username, user.Password)
+				if err == nil {
+					link := opts.LDAP.LinkLocal || opts.LDAP.breakGlass(user.Username)
+					id, err := ldapUserLink(c.Request.Context(), user.Username, email, link)
+					if err == errLDAPUserConflict {
+						audit(c, AuditEvent{Type: auditLoginFailed, Username: user.Username, Detail: "ldap"})
+						respondError(c, http.StatusConflict, errCodeConflict, err)
+						return nil, err
+					}
+					if err != nil {
+						respondDBError(c, err)
+						return nil, err
+					}
+					systemName, err := user.userGetSystemName(c.Request.Context())
+					if err != nil {
+						respondDBError(c, err)
+						return nil, err
+					}
+					audit(c, AuditEvent{Type: auditLogin, Username: user.Username, UserId: id, Detail: "ldap"})
+					return &User{
+						Username:   user.Username,
+						SystemName: systemName,
+						ID:         id,
+					}, nil
+				}
+				if err != errLDAPNoUser {
+					ctxLog(c.Request.Context()).WithError(err).Warn("ldap login failed")
+				}
+				if !opts.LDAP.localFallback(user.Username, err) {
+					audit(c, AuditEvent{Type: auditLoginFailed, Username: user.Username, Detail: "ldap"})
+					return nil, jwt.ErrFailedAuthentication
+				}
+			}
+			exists, err := user.userExists(c.Request.Context())
+			if err != nil {
+				respondDBError(c, err)
+				return nil, err
+			}
+			if exists {
+				id, err := user.userGetID(c.Request.Context())
+				if err != nil {
+					respondDBError(c, err)
+					return nil, err
+				}
+				systemName, err := user.userGetSystemName(c.Request.Context())
+				if err != nil {
+					respondDBError(c, err)
+					return nil, err
+				}
+				audit(c, AuditEvent{Type: auditLogin, Username: user.Username, UserId: id, Detail: "password"})
 				return &User{
 					Username:   user.Username,
-					SystemName: user.userGetSystemName(),
-					ID:         user.userGetID(),
+					SystemName: systemName,
+					ID:         id,
 				}, nil
 			}
-			fmt.Println("failed")
+			audit(c, AuditEvent{Type: auditLoginFailed, Username: user.Username})
 
 			return nil, jwt.ErrFailedAuthentication
 		},
 		Authorizator: func(data interface{}, c *gin.Context) bool {
-			if v, ok := data.(*User); ok && v.usernameExists() {
-				return true
+			v, ok := data.(*User)
+			if !ok {
+				return false
 			}
-			return false
+			exists, err := v.usernameExists(c.Request.Context())
+			if err != nil {
+				respondDBError(c, err)
+				return false
+			}
+			return exists
 		},
 		Unauthorized: func(c *gin.Context, code int, message string) {
+			if c.Writer.Written() {
+				// a db error was already responded to
+				return
+			}
 			c.JSON(code, gin.H{
 				"code":    code,
 				"message": message,
@@ -223,43 +488,149 @@ func setupRouter(dbPath string, logFile string, registration bool) *gin.Engine {
 		log.Fatal("JWT Error:" + err.Error())
 	}
 
+	limitWrite := rateLimit(newLimiter("write", opts.RateLimits.WriteIP, opts.RateLimits.Write))
+	searchLimiter := newLimiter("search", opts.RateLimits.SearchIP, opts.RateLimits.Search)
+	limitSearch := rateLimit(searchLimiter)
+	limitLogin := rateLimit(newLimiter("login", opts.RateLimits.Login, RateLimit{}))
+
 	r.GET("/ping", func(c *gin.Context) {
 		c.JSON(200, gin.H{
 			"message": "pong",
 		})
 	})
+	r.GET("/healthz", healthz)
+	r.GET("/readyz", readyz)
 
-	r.POST("/api/v1/login", authMiddleware.LoginHandler)
+	r.POST("/api/v1/login", limitLogin, authMiddleware.LoginHandler)
 
-	r.POST("/api/v1/user", func(c *gin.Context) {
+	r.POST("/api/v1/user", limitLogin, func(c *gin.Context) {
 		var user User
-        if !registration {
-            c.String(403, "Registration of new users is not allowed.")
-            return
-        }
+		if !opts.Registration {
+			c.String(403, "Registration of new users is not allowed.")
+			return
+		}
 		if err := c.ShouldBindJSON(&user); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			respondError(c, http.StatusBadRequest, errCodeBadRequest, err)
 			return
 		}
 		if user.Email == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "email required"})
+			respondError(c, http.StatusBadRequest, errCodeBadRequest, errors.New("email required"))
+			return
+		}
+		// only break glass accounts can log in locally, and directory
+		// usernames are reserved for the directory user's first login
+		if opts.LDAP.URL != "" {
+			if !opts.LDAP.breakGlass(user.Username) {
+				respondError(c, http.StatusForbidden, errCodeForbidden,
+					errors.New("only --ldap-break-glass accounts can be registered while ldap is enabled"))
+				return
+			}
+			reserved, err := opts.LDAP.userExists(user.Username)
+			if err != nil {
+				_ = c.Error(err)
+				respondError(c, http.StatusServiceUnavailable, errCodeIDPUnavailable, errors.New("ldap directory is unavailable"))
+				return
+			}
+			if reserved {
+				c.String(409, "Username already taken")
+				return
+			}
+		}
+		exists, err := user.usernameExists(c.Request.Context())
+		if err != nil {
+			respondDBError(c, err)
 			return
 		}
-		if user.usernameExists() {
+		if exists {
 			c.String(409, "Username already taken")
 			return
 		}
-		if user.emailExists() {
+		exists, err = user.emailExists(c.Request.Context())
+		if err != nil {
+			respondDBError(c, err)
+			return
+		}
+		if exists {
 			c.String(409, "This email address is already registered.")
 			return
 		}
-		user.userCreate()
-
+		if _, err := user.userCreate(c.Request.Context()); err != nil {
+			respondDBError(c, err)
+			return
+		}
+		id, err := user.userGetID(c.Request.Context())
+		if err != nil {
+			respondDBError(c, err)
+			return
+		}
+		audit(c, AuditEvent{Type: auditUserRegister, Username: user.Username, UserId: id})
 	})
 
-	r.Use(authMiddleware.MiddlewareFunc())
+	if opts.OIDC.Issuer != "" {
+		oidcRoutes(r, authMiddleware, newOIDCProvider(opts.OIDC), limitLogin)
+	}
+
+	r.Use(authenticate(authMiddleware))
+	r.Use(requestUser())
+
+	r.GET("/api/v1/command/stream", requireScope(scopeSearch), commandStream)
+	r.GET("/api/v1/command/ws", requireScope(scopeSearch), searchSocket(opts, searchLimiter))
+	r.GET("/api/v1/command/slowest", requireScope(scopeSearch), limitSearch, func(c *gin.Context) {
+		var command Command
+		claims := jwt.ExtractClaims(c)
+		switch claims["user_id"].(type) {
+		case float64:
+			command.User.ID = uint(claims["user_id"].(float64))
+
+		default:
+			command.User.ID = claims["user_id"].(uint)
+		}
+		command.Limit = 20
+		if c.Query("limit") != "" {
+			if num, err := strconv.Atoi(c.Query("limit")); err == nil {
+				command.Limit = num
+			}
+		}
+		command.Path = c.Query("path")
+		command.SystemName = c.Query("systemName")
+		command.Query = c.Query("query")
+		if command.Query != "" {
+			if err := validatePattern(command.Query); err != nil {
+				respondError(c, http.StatusBadRequest, errCodeBadRequest, err)
+				return
+			}
+		}
+		by := c.DefaultQuery("by", "total")
+		if _, ok := slowestOrders[by]; !ok {
+			respondError(c, http.StatusBadRequest, errCodeBadRequest,
+				fmt.Errorf("by must be total, average or longest, not %q", by))
+			return
+		}
+		var since, until int64
+		var err error
+		for param, v := range map[string]*int64{"since": &since, "until": &until} {
+			if c.Query(param) == "" {
+				continue
+			}
+			if *v, err = strconv.ParseInt(c.Query(param), 10, 64); err != nil {
+				respondError(c, http.StatusBadRequest, errCodeBadRequest, err)
+				return
+			}
+		}
+		result, err := command.commandSlowest(c.Request.Context(), by, since, until)
+		if err != nil {
+			respondDBError(c, err)
+			return
+		}
+		c.IndentedJSON(http.StatusOK, result)
+	})
 
-	r.GET("/api/v1/command/:path", func(c *gin.Context) {
+	r.GET("/api/v1/command/:path", requireScope(scopeSearch), func(c *gin.Context) {
+		// fetching a command by uuid is cheap, only searches count
+		if c.Param("path") == "search" {
+			limitSearch(c)
+		}
+	}, func(c *gin.Context) {
 		var command Command
 		var user User
 		claims := jwt.ExtractClaims(c)
@@ -270,6 +641,7 @@ func setupRouter(dbPath string, logFile string, registration bool) *gin.Engine {
 		default:
 			command.User.ID = claims["user_id"].(uint)
 		}
+		user.Username, _ = claims["username"].(string)
 
 		if c.Param("path") == "search" {
 			command.Limit = 100
@@ -287,12 +659,44 @@ func setupRouter(dbPath string, logFile string, registration bool) *gin.Engine {
 			command.Path = c.Query("path")
 			command.Query = c.Query("query")
 			command.SystemName = c.Query("systemName")
+			if c.Query("minDuration") != "" {
+				ms, err := parseMilliseconds(c.Query("minDuration"))
+				if err != nil {
+					respondError(c, http.StatusBadRequest, errCodeBadRequest, err)
+					return
+				}
+				command.MinDuration = ms
+			}
+			params := searchParams{
+				Mode:     c.DefaultQuery("mode", "regex"),
+				Sort:     c.DefaultQuery("sort", "created"),
+				Here:     frecencyContext{Path: c.Query("contextPath"), SystemName: c.Query("contextSystemName")},
+				Verbose:  c.Query("verbose") == "true",
+				Username: user.Username,
+			}
+			if status, code, err := params.validate(command); status != 0 {
+				respondError(c, status, code, err)
+				return
+			}
 
-			result, err := command.commandGet()
+			ctx := c.Request.Context()
+			if opts.SearchTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, opts.SearchTimeout)
+				defer cancel()
+			}
+			result, truncated, err := command.search(ctx, params)
 			if err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				if ctx.Err() == context.DeadlineExceeded {
+					respondError(c, http.StatusServiceUnavailable, errCodeSearchTimeout, searchTimedOut(opts.SearchTimeout))
+					return
+				}
+				respondDBError(c, err)
 				return
 			}
+			if truncated {
+				c.Header("X-Fuzzy-Truncated", "true")
+			}
 			if len(result) != 0 {
 				c.IndentedJSON(http.StatusOK, result)
 				return
@@ -302,9 +706,9 @@ func setupRouter(dbPath string, logFile string, registration bool) *gin.Engine {
 
 		} else {
 			command.Uuid = c.Param("path")
-			result, err := command.commandGetUUID()
+			result, err := command.commandGetUUID(c.Request.Context())
 			if err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				respondDBError(c, err)
 				return
 			}
 			result.Username = user.Username
@@ -313,10 +717,14 @@ func setupRouter(dbPath string, logFile string, registration bool) *gin.Engine {
 
 	})
 
-	r.POST("/api/v1/command", func(c *gin.Context) {
+	r.POST("/api/v1/command", requireScope(scopeImport), limitWrite, func(c *gin.Context) {
 		var command Command
 		if err := c.ShouldBindJSON(&command); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			respondError(c, http.StatusBadRequest, errCodeBadRequest, err)
+			return
+		}
+		if err := command.timing(); err != nil {
+			respondError(c, http.StatusBadRequest, errCodeBadRequest, err)
 			return
 		}
 		if command.ExitStatus != 0 && command.ExitStatus != 130 {
@@ -331,12 +739,38 @@ func setupRouter(dbPath string, logFile string, registration bool) *gin.Engine {
 			command.User.ID = claims["user_id"].(uint)
 		}
 
-		command.SystemName = claims["systemName"].(string)
-		command.commandInsert()
+		// Api keys and client certificates aren't tied to a system, so their
+		// commands name it in the body.
+		if systemName := claims["systemName"].(string); systemName != "" {
+			command.SystemName = systemName
+		} else if command.SystemName == "" {
+			respondError(c, http.StatusBadRequest, errCodeBadRequest, errors.New("systemName is required when not logged in from a system"))
+			return
+		}
+		inserted, err := command.commandInsert(c.Request.Context())
+		if err != nil {
+			respondDBError(c, err)
+			return
+		}
+		commandsInserted.WithLabelValues(claims["username"].(string), command.SystemName).Add(float64(inserted))
+		if inserted > 0 {
+			commandHub.publish(command.User.ID, Query{
+				Command:    command.Command,
+				Path:       command.Path,
+				Created:    command.Created,
+				Uuid:       command.Uuid,
+				ExitStatus: command.ExitStatus,
+				Username:   claims["username"].(string),
+				SystemName: command.SystemName,
+				StartTime:  command.StartTime,
+				EndTime:    command.EndTime,
+				Duration:   command.Duration,
+			})
+		}
 		c.AbortWithStatus(http.StatusOK)
 	})
 
-	r.DELETE("/api/v1/command/:uuid", func(c *gin.Context) {
+	r.DELETE("/api/v1/command/:uuid", requireScope(scopeAdmin), limitWrite, func(c *gin.Context) {
 		var command Command
 		claims := jwt.ExtractClaims(c)
 		switch claims["user_id"].(type) {
@@ -347,16 +781,23 @@ func setupRouter(dbPath string, logFile string, registration bool) *gin.Engine {
 			command.User.ID = claims["user_id"].(uint)
 		}
 		command.Uuid = c.Param("uuid")
-		command.commandDelete()
+		deleted, err := command.commandDelete(c.Request.Context())
+		if err != nil {
+			respondDBError(c, err)
+			return
+		}
+		if deleted > 0 {
+			audit(c, AuditEvent{Type: auditCommandDelete, Detail: command.Uuid})
+		}
 		c.AbortWithStatus(http.StatusOK)
 
 	})
 
-	r.POST("/api/v1/system", func(c *gin.Context) {
+	r.POST("/api/v1/system", requireScope(scopeAdmin), limitWrite, func(c *gin.Context) {
 		var system System
 		err := c.Bind(&system)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			respondError(c, http.StatusBadRequest, errCodeBadRequest, err)
 			return
 		}
 		claims := jwt.ExtractClaims(c)
@@ -368,11 +809,77 @@ func setupRouter(dbPath string, logFile string, registration bool) *gin.Engine {
 			system.User.ID = claims["user_id"].(uint)
 		}
 
-		system.systemInsert()
+		if _, err := system.systemInsert(c.Request.Context()); err != nil {
+			respondDBError(c, err)
+			return
+		}
+		audit(c, AuditEvent{Type: auditSystemRegister, Detail: system.Mac})
 		c.AbortWithStatus(201)
 	})
 
-	r.GET("/api/v1/system", func(c *gin.Context) {
+	r.GET("/api/v1/session", requireScope(scopeSearch), func(c *gin.Context) {
+		filter := SessionFilter{
+			SystemName: c.Query("systemName"),
+			Limit:      100,
+		}
+		claims := jwt.ExtractClaims(c)
+		switch claims["user_id"].(type) {
+		case float64:
+			filter.UserId = uint(claims["user_id"].(float64))
+
+		default:
+			filter.UserId = claims["user_id"].(uint)
+		}
+		var err error
+		for param, v := range map[string]*int64{"since": &filter.Since, "until": &filter.Until} {
+			if c.Query(param) == "" {
+				continue
+			}
+			if *v, err = strconv.ParseInt(c.Query(param), 10, 64); err != nil {
+				respondError(c, http.StatusBadRequest, errCodeBadRequest, err)
+				return
+			}
+		}
+		if c.Query("limit") != "" {
+			if num, err := strconv.Atoi(c.Query("limit")); err == nil {
+				filter.Limit = num
+			}
+		}
+		result, err := filter.sessionList(c.Request.Context())
+		if err != nil {
+			respondDBError(c, err)
+			return
+		}
+		if len(result) == 0 {
+			result = []Session{}
+		}
+		c.IndentedJSON(http.StatusOK, result)
+	})
+
+	r.GET("/api/v1/session/:id", requireScope(scopeSearch), func(c *gin.Context) {
+		var userID uint
+		claims := jwt.ExtractClaims(c)
+		switch claims["user_id"].(type) {
+		case float64:
+			userID = uint(claims["user_id"].(float64))
+
+		default:
+			userID = claims["user_id"].(uint)
+		}
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, errCodeBadRequest, errors.New("session id must be a number"))
+			return
+		}
+		result, err := sessionGet(c.Request.Context(), userID, id)
+		if err != nil {
+			respondDBError(c, err)
+			return
+		}
+		c.IndentedJSON(http.StatusOK, result)
+	})
+
+	r.GET("/api/v1/system", requireScope(scopeSearch), func(c *gin.Context) {
 		var system System
 		claims := jwt.ExtractClaims(c)
 		switch claims["user_id"].(type) {
@@ -388,20 +895,20 @@ func setupRouter(dbPath string, logFile string, registration bool) *gin.Engine {
 			return
 		}
 		system.Mac = mac
-		result, err := system.systemGet()
+		result, err := system.systemGet(c.Request.Context())
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			respondDBError(c, err)
 			return
 		}
 		c.IndentedJSON(http.StatusOK, result)
 
 	})
 
-	r.PATCH("/api/v1/system/:mac", func(c *gin.Context) {
+	r.PATCH("/api/v1/system/:mac", requireScope(scopeAdmin), limitWrite, func(c *gin.Context) {
 		var system System
 		err := c.Bind(&system)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			respondError(c, http.StatusBadRequest, errCodeBadRequest, err)
 			return
 		}
 		claims := jwt.ExtractClaims(c)
@@ -413,11 +920,14 @@ func setupRouter(dbPath string, logFile string, registration bool) *gin.Engine {
 			system.User.ID = claims["user_id"].(uint)
 		}
 		system.Mac = c.Param("mac")
-		system.systemUpdate()
+		if _, err := system.systemUpdate(c.Request.Context()); err != nil {
+			respondDBError(c, err)
+			return
+		}
 		c.AbortWithStatus(http.StatusOK)
 	})
 
-	r.GET("/api/v1/client-view/status", func(c *gin.Context) {
+	r.GET("/api/v1/client-view/status", requireScope(scopeSearch), func(c *gin.Context) {
 		var status Status
 		claims := jwt.ExtractClaims(c)
 		switch claims["user_id"].(type) {
@@ -431,57 +941,185 @@ func setupRouter(dbPath string, logFile string, registration bool) *gin.Engine {
 		status.SessionName = c.Query("processId")
 		t, err := strconv.Atoi(c.Query("startTime"))
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			respondError(c, http.StatusBadRequest, errCodeBadRequest, err)
 			return
 		}
 		status.SessionStartTime = int64(t)
 
 		pid, err := strconv.Atoi(c.Query("processId"))
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			respondError(c, http.StatusBadRequest, errCodeBadRequest, err)
 			return
 		}
 		status.ProcessID = pid
+		status.SystemName, _ = claims["systemName"].(string)
+		if status.SystemName == "" {
+			status.SystemName = c.Query("systemName")
+		}
 
-		result, err := status.statusGet()
+		result, err := status.statusGet(c.Request.Context(), time.Now())
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			respondDBError(c, err)
 			return
 		}
 
 		c.IndentedJSON(http.StatusOK, result)
 	})
 
-	r.POST("/api/v1/import", func(c *gin.Context) {
-		var imp Import
-		if err := c.ShouldBindJSON(&imp); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	r.POST("/api/v1/import", requireScope(scopeImport), limitWrite, func(c *gin.Context) {
+		imports, err := bindImports(c)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, errCodeBadRequest, err)
 			return
 		}
 		claims := jwt.ExtractClaims(c)
 		user := claims["username"].(string)
-		imp.Username = user
-		err = importCommands(imp)
+		imported, err := importCommands(c.Request.Context(), user, imports)
 		if err != nil {
-			log.Println(err)
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			ctxLog(c.Request.Context()).WithError(err).Warn("import failed")
+			respondDBError(c, err)
 			return
 		}
+		commandsImported.WithLabelValues(user).Add(float64(imported))
+		if imported > 0 {
+			audit(c, AuditEvent{Type: auditImport, Detail: strconv.FormatInt(imported, 10)})
+		}
 		c.AbortWithStatus(http.StatusOK)
 	})
 
-	return r
-}
+	r.POST("/api/v1/apikey", requireScope(scopeAdmin), func(c *gin.Context) {
+		var key APIKey
+		if err := c.ShouldBindJSON(&key); err != nil {
+			respondError(c, http.StatusBadRequest, errCodeBadRequest, err)
+			return
+		}
+		if key.Name == "" {
+			respondError(c, http.StatusBadRequest, errCodeBadRequest, errors.New("name required"))
+			return
+		}
+		switch key.Scope {
+		case scopeSearch, scopeImport, scopeAdmin:
+		default:
+			respondError(c, http.StatusBadRequest, errCodeBadRequest, errors.New("scope must be one of search, import or admin"))
+			return
+		}
+		claims := jwt.ExtractClaims(c)
+		switch claims["user_id"].(type) {
+		case float64:
+			key.User.ID = uint(claims["user_id"].(float64))
+
+		default:
+			key.User.ID = claims["user_id"].(uint)
+		}
+		result, err := key.apiKeyCreate(c.Request.Context())
+		if err != nil {
+			respondDBError(c, err)
+			return
+		}
+		audit(c, AuditEvent{Type: auditAPIKeyCreate, Detail: fmt.Sprintf("%v %v %v", result.ID, result.Name, result.Scope)})
+		c.IndentedJSON(http.StatusCreated, result)
+	})
+
+	r.GET("/api/v1/apikey", requireScope(scopeAdmin), func(c *gin.Context) {
+		var key APIKey
+		claims := jwt.ExtractClaims(c)
+		switch claims["user_id"].(type) {
+		case float64:
+			key.User.ID = uint(claims["user_id"].(float64))
+
+		default:
+			key.User.ID = claims["user_id"].(uint)
+		}
+		result, err := key.apiKeyList(c.Request.Context())
+		if err != nil {
+			respondDBError(c, err)
+			return
+		}
+		if len(result) == 0 {
+			result = []APIKey{}
+		}
+		c.IndentedJSON(http.StatusOK, result)
+	})
+
+	r.DELETE("/api/v1/apikey/:id", requireScope(scopeAdmin), func(c *gin.Context) {
+		var key APIKey
+		claims := jwt.ExtractClaims(c)
+		switch claims["user_id"].(type) {
+		case float64:
+			key.User.ID = uint(claims["user_id"].(float64))
+
+		default:
+			key.User.ID = claims["user_id"].(uint)
+		}
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			respondError(c, http.StatusBadRequest, errCodeBadRequest, err)
+			return
+		}
+		key.ID = uint(id)
+		deleted, err := key.apiKeyDelete(c.Request.Context())
+		if err != nil {
+			respondDBError(c, err)
+			return
+		}
+		if deleted == 0 {
+			respondDBError(c, sql.ErrNoRows)
+			return
+		}
+		audit(c, AuditEvent{Type: auditAPIKeyDelete, Detail: c.Param("id")})
+		c.AbortWithStatus(http.StatusOK)
+	})
 
-// Run starts server
-func Run(dbFile string, logFile string, addr string, registration bool) {
-	r := setupRouter(dbFile, logFile, registration)
+	if opts.MetricsAddr == "" {
+		r.GET("/metrics", requireScope(scopeAdmin), requireAdmin(opts.Admins), gin.WrapH(metricsHandler()))
+	}
+	r.GET("/debug/info", requireScope(scopeAdmin), requireAdmin(opts.Admins), debugInfo(opts))
+	r.GET("/debug/pprof/*name", requireScope(scopeAdmin), requireAdmin(opts.Admins), pprofHandler)
+	// pprof posts symbols to look up
+	r.POST("/debug/pprof/*name", requireScope(scopeAdmin), requireAdmin(opts.Admins), pprofHandler)
 
-	addr = strings.ReplaceAll(addr, "http://", "")
-	err := r.Run(addr)
+	r.GET("/api/v1/audit", requireScope(scopeAdmin), requireAdmin(opts.Admins), func(c *gin.Context) {
+		filter := AuditFilter{
+			Username: c.Query("username"),
+			Type:     c.Query("type"),
+			Limit:    100,
+		}
+		var err error
+		for param, v := range map[string]*int64{"since": &filter.Since, "until": &filter.Until} {
+			if c.Query(param) == "" {
+				continue
+			}
+			if *v, err = strconv.ParseInt(c.Query(param), 10, 64); err != nil {
+				respondError(c, http.StatusBadRequest, errCodeBadRequest, err)
+				return
+			}
+		}
+		if c.Query("limit") != "" {
+			if num, err := strconv.Atoi(c.Query("limit")); err == nil {
+				filter.Limit = num
+			}
+		}
+		result, err := filter.auditGet(c.Request.Context())
+		if err != nil {
+			respondDBError(c, err)
+			return
+		}
+		if len(result) == 0 {
+			result = []AuditEvent{}
+		}
+		c.IndentedJSON(http.StatusOK, result)
+	})
 
+	return r
+}
+
+// Run starts server and blocks until it has been shut down by SIGINT or SIGTERM.
+func Run(opts Options) {
+	s, err := NewServer(opts)
 	if err != nil {
+		log.Fatal(err)
+	}
+	if err := s.Run(); err != nil {
 		fmt.Println("Error: \t", err)
 	}
-
 }
@@ -19,7 +19,9 @@
 package internal
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -31,12 +33,15 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -47,10 +52,13 @@ var (
 	pid              string
 	dir              string
 	router           *gin.Engine
+	idpRouter        *gin.Engine
 	sysRegistered    bool
 	jwtToken         string
 	testDir          string
 	system           sysStruct
+	oidcServer       *testOIDCServer
+	ldapServer       *testLDAPServer
 )
 
 type sysStruct struct {
@@ -74,8 +82,13 @@ func TestMain(m *testing.M) {
 
 	dbPath := filepath.Join(testDir, "test.db")
 	logFile := filepath.Join(testDir, "server.log")
+	oidcServer = newTestOIDCServer()
+	defer oidcServer.Close()
+	ldapServer = newTestLDAPServer()
+	defer ldapServer.Close()
 	log.Print("sqlite tests")
-	router = setupRouter(dbPath, logFile, true)
+	router = setupRouter(Options{DB: dbPath, Log: logFile, Registration: true, Admins: []string{"tester"}})
+	idpRouter = newRouter(Options{Registration: true, OIDC: oidcTestConfig(oidcServer), LDAP: ldapTestConfig(ldapServer)})
 
 	system = sysStruct{
 		user:  "tester",
@@ -90,7 +103,8 @@ func TestMain(m *testing.M) {
 		log.Print("postgres tests")
 		dbPath := *postgres
 		logFile := filepath.Join(testDir, "postgres-server.log")
-		router = setupRouter(dbPath, logFile, true)
+		router = setupRouter(Options{DB: dbPath, Log: logFile, Registration: true, Admins: []string{"tester"}})
+		idpRouter = newRouter(Options{Registration: true, OIDC: oidcTestConfig(oidcServer), LDAP: ldapTestConfig(ldapServer)})
 		m.Run()
 	}
 
@@ -105,6 +119,13 @@ func testRequest(method string, u string, body io.Reader) *httptest.ResponseReco
 	return w
 }
 
+// useRouter makes testRequest use r until the returned func is called.
+func useRouter(r *gin.Engine) func() {
+	prev := router
+	router = r
+	return func() { router = prev }
+}
+
 func check(err error) {
 	if err != nil {
 		log.Fatal(err)
@@ -371,7 +392,1034 @@ func TestStatus(t *testing.T) {
 	assert.Equal(t, status.TotalSystems, 3)
 	assert.Equal(t, status.TotalCommandsToday, 49)
 	assert.Equal(t, status.SessionTotalCommands, 9)
+	assert.Equal(t, system.systemName, status.SystemName)
+	assert.Equal(t, 49, status.SystemTotalCommands)
+	assert.Equal(t, 5, status.SystemTotalSessions)
+	assert.Equal(t, statusTopCommands, len(status.TopCommandsToday))
+	assert.Equal(t, 5, status.TopCommandsToday[0].Count)
+	assert.Equal(t, dir, status.MostActivePathToday)
+
+}
+
+func TestAPIKey(t *testing.T) {
+	testRequestAs := func(token string, method string, u string, body io.Reader) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, u, body)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Add("Authorization", "Bearer "+token)
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := testRequest("POST", "/api/v1/apikey", bytes.NewReader([]byte(`{"name": "ci", "scope": "write"}`)))
+	assert.Equal(t, 400, w.Code)
+
+	w = testRequest("POST", "/api/v1/apikey", bytes.NewReader([]byte(`{"name": "ci", "scope": "search"}`)))
+	assert.Equal(t, 201, w.Code)
+	var key APIKey
+	err := json.Unmarshal(w.Body.Bytes(), &key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "search", key.Scope)
+	assert.Contains(t, key.Key, key.Prefix)
+
+	w = testRequestAs(key.Key, "GET", "/api/v1/command/search?limit=1", nil)
+	assert.Equal(t, 200, w.Code)
+	var data []Query
+	err = json.Unmarshal(w.Body.Bytes(), &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(data))
+
+	// like JWTs, api keys can be the token query parameter or jwt cookie, as
+	// browsers can't set the header on event streams and websockets
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/v1/command/search?limit=1&token="+key.Key, nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/command/search?limit=1", nil)
+	req.AddCookie(&http.Cookie{Name: "jwt", Value: key.Key})
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/command/search?limit=1&token="+apiKeyPrefix+"invalid", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 401, w.Code)
+
+	w = testRequestAs(key.Key, "POST", "/api/v1/import", bytes.NewReader([]byte(`{}`)))
+	assert.Equal(t, 403, w.Code)
+	assert.Contains(t, w.Body.String(), `"errorCode":"forbidden"`)
+	w = testRequestAs(key.Key, "POST", "/api/v1/apikey", bytes.NewReader([]byte(`{"name": "x", "scope": "admin"}`)))
+	assert.Equal(t, 403, w.Code)
+	w = testRequestAs(apiKeyPrefix+"bogus", "GET", "/api/v1/command/search?limit=1", nil)
+	assert.Equal(t, 401, w.Code)
+
+	w = testRequest("GET", "/api/v1/apikey", nil)
+	assert.Equal(t, 200, w.Code)
+	var keys []APIKey
+	err = json.Unmarshal(w.Body.Bytes(), &keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(keys))
+	assert.Equal(t, "", keys[0].Key)
+	assert.NotEqual(t, int64(0), keys[0].LastUsed)
+
+	w = testRequest("DELETE", fmt.Sprintf("/api/v1/apikey/%v", key.ID), nil)
+	assert.Equal(t, 200, w.Code)
+	w = testRequestAs(key.Key, "GET", "/api/v1/command/search?limit=1", nil)
+	assert.Equal(t, 401, w.Code)
+
+	w = testRequest("POST", "/api/v1/apikey", bytes.NewReader([]byte(`{"name": "ingest", "scope": "import"}`)))
+	assert.Equal(t, 201, w.Code)
+	err = json.Unmarshal(w.Body.Bytes(), &key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	command := func(systemName string) io.Reader {
+		return bytes.NewReader([]byte(fmt.Sprintf(`{"command": "apikey ingest", "path": "/tmp", "created": %v, "uuid": "%v", "exitStatus": 0, "systemName": "%v"}`,
+			time.Now().UnixNano()/int64(time.Millisecond), uuid.New().String(), systemName)))
+	}
+	w = testRequestAs(key.Key, "POST", "/api/v1/command", command(""))
+	assert.Equal(t, 400, w.Code)
+	w = testRequestAs(key.Key, "POST", "/api/v1/command", command("apikey-host"))
+	assert.Equal(t, 200, w.Code)
+	w = testRequest("GET", "/api/v1/command/search?query="+url.QueryEscape("^apikey ingest$")+"&systemName=apikey-host", nil)
+	assert.Equal(t, 200, w.Code)
+	err = json.Unmarshal(w.Body.Bytes(), &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(data))
+}
+
+func TestAudit(t *testing.T) {
+	assert.Equal(t, 401, login(system.user, "wrong"))
+
+	events := func(query string) []AuditEvent {
+		w := testRequest("GET", "/api/v1/audit?"+query, nil)
+		assert.Equal(t, 200, w.Code)
+		var data []AuditEvent
+		err := json.Unmarshal(w.Body.Bytes(), &data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	deleted := events("type=command_delete")
+	assert.Equal(t, 1, len(deleted))
+	assert.Equal(t, system.user, deleted[0].Username)
+	w := testRequest("DELETE", "/api/v1/command/no-such-uuid", nil)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, 1, len(events("type=command_delete")))
+
+	var uuids []string
+	var imports []Import
+	for i := 0; i < 3; i++ {
+		uuids = append(uuids, uuid.New().String())
+		imports = append(imports, Import{Command: "audit import", Path: "/tmp", Created: time.Now().UnixNano() / int64(time.Millisecond), Uuid: uuids[i], SystemName: "audit-host"})
+	}
+	payload, _ := json.Marshal(imports[:1])
+	w = testRequest("POST", "/api/v1/import", bytes.NewReader(payload))
+	assert.Equal(t, 200, w.Code)
+	payload, _ = json.Marshal(imports)
+	w = testRequest("POST", "/api/v1/import", bytes.NewReader(payload))
+	assert.Equal(t, 200, w.Code)
+	imported := events("type=import")
+	assert.Equal(t, 2, len(imported))
+	assert.Equal(t, "2", imported[0].Detail)
+	assert.Equal(t, "1", imported[1].Detail)
+	for _, id := range uuids {
+		w = testRequest("DELETE", "/api/v1/command/"+id, nil)
+		assert.Equal(t, 200, w.Code)
+	}
+
+	failed := events(fmt.Sprintf("type=login_failed&username=%v", system.user))
+	assert.Equal(t, 1, len(failed))
+
+	assert.Equal(t, 3, len(events("type=system_register")))
+	assert.Equal(t, 0, len(events(fmt.Sprintf("type=login&since=%v", time.Now().Add(time.Hour).Unix()))))
+	assert.Equal(t, 2, len(events("limit=2")))
+
+	_, err := db.Exec(`DELETE FROM audit_events`)
+	assert.Error(t, err)
+
+	w = testRequest("POST", "/api/v1/apikey", bytes.NewReader([]byte(`{"name": "ci", "scope": "search"}`)))
+	assert.Equal(t, 201, w.Code)
+	var key APIKey
+	err = json.Unmarshal(w.Body.Bytes(), &key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/v1/audit", nil)
+	req.Header.Add("Authorization", "Bearer "+key.Key)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 403, w.Code)
+
+	// the ip is the remote address, not a header the client can set
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/login", strings.NewReader(`{"username": "audit-spoof", "password": "wrong"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 401, w.Code)
+	spoofed := events("type=login_failed&username=audit-spoof")
+	assert.Equal(t, 1, len(spoofed))
+	assert.Equal(t, "192.0.2.1", spoofed[0].IP)
+}
+
+func TestMetrics(t *testing.T) {
+	w := testRequest("GET", "/metrics", nil)
+	assert.Equal(t, 200, w.Code)
+	body := w.Body.String()
+	for _, want := range []string{
+		`bashhub_http_requests_total{code="200",method="POST",route="/api/v1/command"}`,
+		`bashhub_http_request_duration_seconds_count{method="GET",route="/api/v1/command/:path"}`,
+		fmt.Sprintf(`bashhub_commands_inserted_total{system="system-3",user="%v"}`, system.user),
+		`bashhub_logins_total{method="password",result="failure"}`,
+		`bashhub_logins_total{method="password",result="success"}`,
+		`bashhub_db_query_duration_seconds_count{statement="select"}`,
+		`bashhub_db_open_connections`,
+	} {
+		assert.Contains(t, body, want)
+	}
+
+	w = testRequest("POST", "/api/v1/apikey", bytes.NewReader([]byte(`{"name": "metrics", "scope": "search"}`)))
+	assert.Equal(t, 201, w.Code)
+	var key APIKey
+	err := json.Unmarshal(w.Body.Bytes(), &key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	req.Header.Add("Authorization", "Bearer "+key.Key)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 403, w.Code)
+}
+
+func TestErrorResponses(t *testing.T) {
+	errorCode := func(u string) (int, string) {
+		w := testRequest("GET", u, nil)
+		var data map[string]interface{}
+		err := json.Unmarshal(w.Body.Bytes(), &data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		code, _ := data["errorCode"].(string)
+		return w.Code, code
+	}
+	code, errCode := errorCode("/api/v1/command/no-such-uuid")
+	assert.Equal(t, 404, code)
+	assert.Equal(t, errCodeNotFound, errCode)
+
+	code, errCode = errorCode("/api/v1/system?mac=no-such-mac")
+	assert.Equal(t, 404, code)
+	assert.Equal(t, errCodeNotFound, errCode)
+
+	code, errCode = errorCode("/api/v1/command/search?query=" + url.QueryEscape("(a+)+"))
+	assert.Equal(t, 400, code)
+	assert.Equal(t, errCodeBadRequest, errCode)
+
+	code, errCode = errorCode("/api/v1/client-view/status?processId=x&startTime=1")
+	assert.Equal(t, 400, code)
+	assert.Equal(t, errCodeBadRequest, errCode)
+}
+
+func TestHealth(t *testing.T) {
+	for _, u := range []string{"/healthz", "/readyz"} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", u, nil)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, 200, w.Code, u)
+		var data map[string]interface{}
+		err := json.Unmarshal(w.Body.Bytes(), &data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "ok", data["status"], u)
+	}
+
+	w := testRequest("GET", "/debug/info", nil)
+	assert.Equal(t, 200, w.Code)
+	var info struct {
+		GoVersion string `json:"goVersion"`
+		DB        struct {
+			Dialect string           `json:"dialect"`
+			Rows    map[string]int64 `json:"rows"`
+			Pool    struct {
+				MaxOpenConnections int `json:"maxOpenConnections"`
+			} `json:"pool"`
+		} `json:"db"`
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEmpty(t, info.GoVersion)
+	assert.Equal(t, dbDialect(), info.DB.Dialect)
+	assert.Equal(t, len(dbTables), len(info.DB.Rows))
+	assert.NotZero(t, info.DB.Rows["users"])
+	assert.Equal(t, connectionLimit, info.DB.Pool.MaxOpenConnections)
+
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/debug/info", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 401, w.Code)
+}
+
+func TestPprof(t *testing.T) {
+	w := testRequest("GET", "/debug/pprof/", nil)
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), "goroutine")
+
+	w = testRequest("GET", "/debug/pprof/heap", nil)
+	assert.Equal(t, 200, w.Code)
+	assert.NotZero(t, w.Body.Len())
+
+	w = testRequest("GET", "/debug/pprof/trace?seconds=1", nil)
+	assert.Equal(t, 200, w.Code)
+	assert.NotZero(t, w.Body.Len())
+
+	w = testRequest("GET", "/debug/pprof/cmdline", nil)
+	assert.Equal(t, 404, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/debug/pprof/heap", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 401, w.Code)
+}
+
+// insertCommand adds command to the test user's history and returns its uuid.
+func insertCommand(t *testing.T, command string, created int64) string {
+	return insertCommandIn(t, dir, command, created)
+}
+
+// insertCommandIn adds command as run in path at created and returns its uuid.
+func insertCommandIn(t *testing.T, path, command string, created int64) string {
+	uid, err := uuid.NewRandom()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := Command{
+		Command:          command,
+		Path:             path,
+		Created:          created,
+		ProcessStartTime: sessionStartTime,
+		Uuid:             uid.String(),
+	}
+	payloadBytes, err := json.Marshal(&tc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := testRequest("POST", "/api/v1/command", bytes.NewReader(payloadBytes))
+	assert.Equal(t, 200, w.Code)
+	return tc.Uuid
+}
+
+func TestCommandSearchFTS(t *testing.T) {
+	if ftsUnavailable != nil {
+		w := testRequest("GET", "/api/v1/command/search?mode=fts&query=ls", nil)
+		assert.Equal(t, 501, w.Code)
+		t.Skip("full text search is unavailable: ", ftsUnavailable)
+	}
+	created := time.Now().Unix() * 1000
+	insertCommand(t, "kubectl rollout status deploy/api -n staging", created)
+	insertCommand(t, "kubectl rollout restart deploy/api -n production", created+1)
+	insertCommand(t, "kubectl get pods -n staging", created+2)
+	latest := insertCommand(t, "kubectl rollout status deploy/api -n staging", created+3)
+
+	search := func(query string) []Query {
+		w := testRequest("GET", "/api/v1/command/search?"+query, nil)
+		assert.Equal(t, 200, w.Code, query)
+		var data []Query
+		_ = json.Unmarshal(w.Body.Bytes(), &data)
+		return data
+	}
+	data := search("mode=fts&query=" + url.QueryEscape("kubectl rollout staging"))
+	assert.Equal(t, 2, len(data))
+	assert.Equal(t, latest, data[0].Uuid)
+	data = search("mode=fts&unique=true&query=" + url.QueryEscape("kubectl rollout staging"))
+	assert.Equal(t, 1, len(data))
+	assert.Equal(t, latest, data[0].Uuid)
+	data = search("mode=fts&query=" + url.QueryEscape("deploy/api"))
+	assert.Equal(t, 3, len(data))
+	data = search("mode=fts&query=" + url.QueryEscape("staging -n") + "&path=" + url.QueryEscape(dir) + "&limit=1")
+	assert.Equal(t, 1, len(data))
+	// "status" is a better match than the restart command, which is more recent
+	data = search("mode=fts&unique=true&query=" + url.QueryEscape("rollout status"))
+	assert.Equal(t, 1, len(data))
+	assert.Equal(t, "kubectl rollout status deploy/api -n staging", data[0].Command)
+
+	w := testRequest("DELETE", "/api/v1/command/"+latest, nil)
+	assert.Equal(t, 200, w.Code)
+	data = search("mode=fts&query=" + url.QueryEscape("kubectl rollout staging"))
+	assert.Equal(t, 1, len(data))
+	assert.NotEqual(t, latest, data[0].Uuid)
+
+	w = testRequest("GET", "/api/v1/command/search?mode=glob&query=ls", nil)
+	assert.Equal(t, 400, w.Code)
+
+	if connectionLimit == 1 {
+		// commands from before the index existed are added when it's created
+		_, err := db.Exec(`DROP TABLE commands_fts`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ftsInit()
+		assert.Nil(t, ftsUnavailable)
+		data = search("mode=fts&query=" + url.QueryEscape("kubectl rollout"))
+		assert.Equal(t, 2, len(data))
+	}
+}
+
+// TestFTSAcrossBuilds opens a database made by a build with the sqlite_fts5
+// tag without it, and the other way around.
+func TestFTSAcrossBuilds(t *testing.T) {
+	if connectionLimit != 1 {
+		t.Skip("fts5 is sqlite's")
+	}
+	triggers := func() int {
+		var n int
+		err := db.QueryRow(`SELECT count(*) FROM sqlite_master WHERE "type" = 'trigger' AND "name" LIKE 'commands_fts_%'`).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	if ftsUnavailable == nil {
+		// commands saved without the tag, which dropped the triggers, are
+		// indexed when it's back
+		_, err := db.Exec(`
+		DROP TRIGGER commands_fts_insert;
+		DROP TRIGGER commands_fts_delete;
+		DROP TRIGGER commands_fts_update;`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		insertCommand(t, "helm upgrade ingress-nginx", time.Now().Unix()*1000)
+		ftsInit()
+		assert.Nil(t, ftsUnavailable)
+		assert.Equal(t, 3, triggers())
+		w := testRequest("GET", "/api/v1/command/search?mode=fts&query=ingress-nginx", nil)
+		assert.Equal(t, 200, w.Code)
+		assert.Contains(t, w.Body.String(), "helm upgrade ingress-nginx")
+		return
+	}
+
+	// without the module the table and triggers of a build with the tag are
+	// still in the schema
+	schema := func(statement string) {
+		_, err := db.Exec(`PRAGMA writable_schema = ON;` + statement + `; PRAGMA writable_schema = OFF;`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a new connection reads the changed schema
+		db.SetMaxIdleConns(0)
+		db.SetMaxIdleConns(2)
+	}
+	schema(`INSERT INTO sqlite_master ("type", "name", "tbl_name", "rootpage", "sql") VALUES ('table', 'commands_fts',
+		'commands_fts', 0, 'CREATE VIRTUAL TABLE commands_fts USING fts5("command", "uuid" UNINDEXED)')`)
+	defer schema(`DELETE FROM sqlite_master WHERE "name" = 'commands_fts'`)
+	_, err := db.Exec(`
+	CREATE TRIGGER commands_fts_insert AFTER INSERT ON commands
+	BEGIN INSERT INTO commands_fts ("command", "uuid") VALUES (new."command", new."uuid"); END;
+	CREATE TRIGGER commands_fts_delete AFTER DELETE ON commands
+	BEGIN DELETE FROM commands_fts WHERE "uuid" = old."uuid"; END;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ftsInit()
+	assert.NotNil(t, ftsUnavailable)
+	assert.Equal(t, 0, triggers())
+	id := insertCommand(t, "helm upgrade ingress-nginx", time.Now().Unix()*1000)
+	w := testRequest("DELETE", "/api/v1/command/"+id, nil)
+	assert.Equal(t, 200, w.Code)
+}
+
+func TestCommandSearchFuzzy(t *testing.T) {
+	created := time.Now().Unix() * 1000
+	insertCommand(t, "terraform plan -var-file=staging.tfvars", created)
+	insertCommand(t, "terraform apply -var-file=production.tfvars", created+1)
+	latest := insertCommand(t, "terraform plan -var-file=staging.tfvars", created+2)
+	insertCommand(t, "tar -xf plan.tar", created+3)
+
+	search := func(query string) []Query {
+		w := testRequest("GET", "/api/v1/command/search?mode=fuzzy&"+query, nil)
+		assert.Equal(t, 200, w.Code, query)
+		assert.Empty(t, w.Header().Get("X-Fuzzy-Truncated"))
+		var data []Query
+		_ = json.Unmarshal(w.Body.Bytes(), &data)
+		return data
+	}
+	// words match in any order
+	data := search("query=" + url.QueryEscape("stag tfplan"))
+	assert.Equal(t, 2, len(data))
+	assert.Equal(t, latest, data[0].Uuid)
+	assert.NotZero(t, data[0].Score)
+	assert.Equal(t, []int{0, 5, 10, 11, 12, 13, 25, 26, 27, 28}, data[0].Positions)
+
+	data = search("unique=true&query=" + url.QueryEscape("tfplan stag"))
+	assert.Equal(t, 1, len(data))
+	assert.Equal(t, latest, data[0].Uuid)
+
+	data = search("unique=true&query=" + url.QueryEscape("tfplan"))
+	assert.Equal(t, 3, len(data))
+	assert.Equal(t, "tar -xf plan.tar", data[0].Command)
+	assert.True(t, data[0].Score > data[1].Score)
+	assert.True(t, data[1].Score >= data[2].Score)
 
+	data = search("limit=1&path=" + url.QueryEscape(dir) + "&query=" + url.QueryEscape("terra app"))
+	assert.Equal(t, 1, len(data))
+	assert.Equal(t, "terraform apply -var-file=production.tfvars", data[0].Command)
+
+	data = search("query=" + url.QueryEscape("100%"))
+	assert.Equal(t, 0, len(data))
+
+	// more candidates than are scored, for a user of their own
+	other := User{ID: 1 << 20}
+	tx, err := db.BeginTx(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i <= maxFuzzyCandidates; i++ {
+		_, err := tx.Exec(`INSERT INTO commands ("command", "uuid", "created", "user_id") VALUES ($1, $2, $3, $4)`,
+			"fuzzy candidate", uuid.New().String(), created+i, other.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(tx.Commit())
+	defer db.Exec(`DELETE FROM commands WHERE "user_id" = $1`, other.ID)
+	data, truncated, err := Command{Query: "fzcand", Limit: 1, User: other}.commandSearchFuzzy(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, truncated)
+	assert.Equal(t, 1, len(data))
+	if trgmAvailable {
+		// the most similar are scored however old they are
+		_, err = db.Exec(`INSERT INTO commands ("command", "uuid", "created", "user_id") VALUES ($1, $2, $3, $4)`,
+			"fzcand", uuid.New().String(), created-1, other.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, truncated, err = Command{Query: "fzcand", Limit: 1, User: other}.commandSearchFuzzy(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, truncated)
+		assert.Equal(t, "fzcand", data[0].Command)
+		_, err = db.Exec(`DELETE FROM commands WHERE "user_id" = $1 AND "command" = $2`, other.ID, "fzcand")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// exactly as many as are scored isn't truncated
+	_, err = db.Exec(`DELETE FROM commands WHERE "user_id" = $1 AND "created" = $2`, other.ID, created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, truncated, err = Command{Query: "fzcand", Limit: 1, User: other}.commandSearchFuzzy(context.Background())
+	assert.NoError(t, err)
+	assert.False(t, truncated)
+	_, truncated, err = Command{Query: "fzcand", Limit: 1, User: other, MinDuration: 1}.commandSearchFuzzy(context.Background())
+	assert.NoError(t, err)
+	assert.False(t, truncated)
+}
+
+func TestCommandSearchFrecency(t *testing.T) {
+	day := int64(24 * time.Hour / time.Millisecond)
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	for i := int64(0); i < 3; i++ {
+		insertCommand(t, "frecency often", now-60*day-i)
+	}
+	insertCommand(t, "frecency old", now-200*day)
+	recent := insertCommand(t, "frecency recent", now)
+
+	search := func(query string) []Query {
+		w := testRequest("GET", "/api/v1/command/search?sort=frecency&query="+url.QueryEscape("^frecency")+"&"+query, nil)
+		assert.Equal(t, 200, w.Code, query)
+		var data []Query
+		_ = json.Unmarshal(w.Body.Bytes(), &data)
+		return data
+	}
+	data := search("")
+	assert.Equal(t, 3, len(data))
+	assert.Equal(t, recent, data[0].Uuid)
+	assert.Equal(t, 100, data[0].Score)
+	assert.Equal(t, "frecency often", data[1].Command)
+	assert.Equal(t, 90, data[1].Score)
+	assert.Equal(t, "frecency old", data[2].Command)
+
+	// runs in the caller's directory count three times over
+	here := insertCommandIn(t, "/srv/frecency", "frecency old", now-200*day+1)
+	data = search("limit=1&contextPath=" + url.QueryEscape("/srv/frecency"))
+	assert.Equal(t, 1, len(data))
+	assert.Equal(t, "frecency recent", data[0].Command)
+	data = search("contextPath=" + url.QueryEscape("/srv/frecency"))
+	assert.Equal(t, "frecency old", data[2].Command)
+	assert.Equal(t, 40, data[2].Score)
+	assert.Equal(t, here, data[2].Uuid)
+
+	w := testRequest("GET", "/api/v1/command/search?sort=oldest", nil)
+	assert.Equal(t, 400, w.Code)
+	w = testRequest("GET", "/api/v1/command/search?sort=frecency&mode=fuzzy&query=ls", nil)
+	assert.Equal(t, 400, w.Code)
+}
+
+func TestCommandSearchUnique(t *testing.T) {
+	created := time.Now().Unix() * 1000
+	insertCommand(t, "unique make test", created-10)
+	insertCommand(t, "unique make build", created-5)
+	tied := []string{
+		insertCommand(t, "unique make test", created),
+		insertCommandIn(t, "/srv/unique", "unique make test", created),
+	}
+	sort.Strings(tied)
+
+	searches := []string{"query=" + url.QueryEscape("^unique"), "mode=fuzzy&query=" + url.QueryEscape("unique make")}
+	if ftsUnavailable == nil {
+		searches = append(searches, "mode=fts&query="+url.QueryEscape("unique make"))
+	}
+	for _, search := range searches {
+		// the same results on every run and in every mode
+		for i := 0; i < 3; i++ {
+			w := testRequest("GET", "/api/v1/command/search?unique=true&"+search, nil)
+			assert.Equal(t, 200, w.Code, search)
+			var data []Query
+			_ = json.Unmarshal(w.Body.Bytes(), &data)
+			assert.Equal(t, 2, len(data), search)
+			byCommand := map[string]Query{}
+			for _, q := range data {
+				byCommand[q.Command] = q
+			}
+			test := byCommand["unique make test"]
+			assert.Equal(t, tied[1], test.Uuid, search)
+			assert.Equal(t, created, test.Created, search)
+			assert.Equal(t, created-10, test.FirstSeen, search)
+			assert.Equal(t, 3, test.Count, search)
+			build := byCommand["unique make build"]
+			assert.Equal(t, 1, build.Count, search)
+			assert.Equal(t, created-5, build.FirstSeen, search)
+			assert.Equal(t, dir, build.Path, search)
+			assert.Equal(t, system.systemName, build.SystemName, search)
+		}
+	}
+	w := testRequest("GET", "/api/v1/command/search?unique=true&query="+url.QueryEscape("^unique"), nil)
+	var data []Query
+	_ = json.Unmarshal(w.Body.Bytes(), &data)
+	assert.Equal(t, "unique make test", data[0].Command)
+	assert.Equal(t, "unique make build", data[1].Command)
+
+	w = testRequest("GET", "/api/v1/command/search?unique=true&path=/srv/unique", nil)
+	assert.Equal(t, 200, w.Code)
+	data = nil
+	_ = json.Unmarshal(w.Body.Bytes(), &data)
+	assert.Equal(t, 1, len(data))
+	assert.Equal(t, 1, data[0].Count)
+	assert.Equal(t, "/srv/unique", data[0].Path)
+}
+
+func TestCommandSearchVerbose(t *testing.T) {
+	created := time.Now().Unix() * 1000
+	id := insertCommandIn(t, "/srv/verbose", "verbose make", created)
+
+	search := func(query string) []Query {
+		w := testRequest("GET", "/api/v1/command/search?"+query, nil)
+		assert.Equal(t, 200, w.Code, query)
+		var data []Query
+		_ = json.Unmarshal(w.Body.Bytes(), &data)
+		return data
+	}
+	data := search("query=^verbose")
+	assert.Equal(t, 1, len(data))
+	assert.Empty(t, data[0].Path)
+	assert.Empty(t, data[0].SystemName)
+
+	for _, query := range []string{
+		"verbose=true&query=^verbose",
+		"verbose=true&unique=true&query=^verbose",
+		"verbose=true&sort=frecency&query=^verbose",
+		"verbose=true&mode=fuzzy&query=verbose+make",
+	} {
+		data = search(query)
+		assert.Equal(t, 1, len(data), query)
+		assert.Equal(t, id, data[0].Uuid, query)
+		assert.Equal(t, "/srv/verbose", data[0].Path, query)
+		assert.Equal(t, system.systemName, data[0].SystemName, query)
+		assert.Equal(t, system.user, data[0].Username, query)
+		assert.NotNil(t, data[0].SessionID, query)
+	}
+
+	// the same as looking each one up
+	w := testRequest("GET", "/api/v1/command/"+id, nil)
+	assert.Equal(t, 200, w.Code)
+	var one Query
+	_ = json.Unmarshal(w.Body.Bytes(), &one)
+	data = search("verbose=true&query=^verbose")
+	assert.Equal(t, one, data[0])
+}
+
+func TestCommandStream(t *testing.T) {
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequest("GET", srv.URL+"/api/v1/command/stream?path=/srv/stream", nil)
+	req.Header.Add("Authorization", jwtToken)
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	// next returns the next event's name and data
+	lines := bufio.NewScanner(resp.Body)
+	next := func() (string, string) {
+		var event, data string
+		for lines.Scan() {
+			switch line := lines.Text(); {
+			case strings.HasPrefix(line, "event:"):
+				event = strings.TrimPrefix(line, "event:")
+			case strings.HasPrefix(line, "data:"):
+				data = strings.TrimPrefix(line, "data:")
+			case line == "" && event != "":
+				return event, data
+			}
+		}
+		t.Fatal("stream ended: ", lines.Err())
+		return "", ""
+	}
+	event, _ := next()
+	assert.Equal(t, "ready", event)
+
+	created := time.Now().Unix() * 1000
+	first := insertCommandIn(t, "/srv/stream", "stream make", created)
+	insertCommandIn(t, "/srv/elsewhere", "stream ls", created+1)
+	second := insertCommandIn(t, "/srv/stream", "stream make test", created+2)
+	for _, id := range []string{first, second} {
+		event, data := next()
+		assert.Equal(t, "command", event)
+		var q Query
+		if err := json.Unmarshal([]byte(data), &q); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, id, q.Uuid)
+		assert.Equal(t, "/srv/stream", q.Path)
+		assert.Equal(t, system.systemName, q.SystemName)
+	}
+
+	w := httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/command/stream", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 401, w.Code)
+}
+
+func TestSearchSocket(t *testing.T) {
+	created := time.Now().Unix() * 1000
+	for i := 0; i < 60; i++ {
+		insertCommand(t, fmt.Sprintf("socket batch %v", i), created+int64(i))
+	}
+
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+	header := http.Header{"Authorization": {jwtToken}}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/api/v1/command/ws", header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	read := func() searchReply {
+		var reply searchReply
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err := conn.ReadJSON(&reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+
+	// results come in batches
+	assert.Nil(t, conn.WriteJSON(searchMessage{ID: 1, Query: "^socket batch"}))
+	reply := read()
+	assert.Equal(t, 1, reply.ID)
+	assert.Equal(t, wsBatchSize, len(reply.Results))
+	assert.Equal(t, "socket batch 59", reply.Results[0].Command)
+	assert.False(t, reply.Done)
+	reply = read()
+	assert.Equal(t, 60-wsBatchSize, len(reply.Results))
+	assert.True(t, reply.Done)
+
+	// a bad search doesn't end the connection
+	assert.Nil(t, conn.WriteJSON(searchMessage{ID: 2, Query: "(a+)+"}))
+	reply = read()
+	assert.Equal(t, 2, reply.ID)
+	assert.Equal(t, errCodeBadRequest, reply.ErrorCode)
+	assert.True(t, reply.Done)
+
+	// only the last of a burst of searches has to be answered
+	for i, query := range []string{"s", "so", "soc", "sock", "socket batch 7"} {
+		assert.Nil(t, conn.WriteJSON(searchMessage{ID: 3 + i, Query: query, Mode: "fuzzy", Limit: 1}))
+	}
+	for reply = read(); reply.ID != 7; reply = read() {
+		assert.True(t, reply.ID > 2 && reply.ID < 7)
+	}
+	assert.True(t, reply.Done)
+	assert.Equal(t, 1, len(reply.Results))
+	assert.Equal(t, "socket batch 7", reply.Results[0].Command)
+
+	assert.Nil(t, conn.WriteJSON(searchMessage{ID: 8, Query: "^nothing like this$"}))
+	reply = read()
+	assert.Equal(t, 8, reply.ID)
+	assert.Equal(t, []Query{}, reply.Results)
+	assert.True(t, reply.Done)
+
+	// minDuration takes a duration like the search endpoint's
+	assert.Nil(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"id": 9, "query": "^socket batch", "minDuration": "1m"}`)))
+	reply = read()
+	assert.Equal(t, 9, reply.ID)
+	assert.Empty(t, reply.ErrorCode)
+	assert.Equal(t, []Query{}, reply.Results)
+	assert.Nil(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"id": 10, "query": "^socket batch", "minDuration": "soon"}`)))
+	reply = read()
+	assert.Equal(t, errCodeBadRequest, reply.ErrorCode)
+
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/api/v1/command/ws", nil)
+	assert.NotNil(t, err)
+	assert.Equal(t, 401, resp.StatusCode)
+
+	// shutting down closes open sockets and waits for their handlers
+	searchSockets.closeAll()
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), err)
+	searchSockets.wait()
+}
+
+func TestSessions(t *testing.T) {
+	// later than the other tests' commands
+	start := time.Now().AddDate(1, 0, 0).Unix() * 1000
+	run := func(command, path string, created int64) {
+		tc := Command{
+			Command:          command,
+			Path:             path,
+			Created:          created,
+			ProcessId:        4242,
+			ProcessStartTime: start,
+			Uuid:             uuid.New().String(),
+		}
+		payloadBytes, err := json.Marshal(&tc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := testRequest("POST", "/api/v1/command", bytes.NewReader(payloadBytes))
+		assert.Equal(t, 200, w.Code)
+	}
+	run("cd /srv/app", "/home", start+1000)
+	run("make deploy", "/srv/app", start+3000)
+	// commands can arrive out of order
+	run("git pull", "/srv/app", start+2000)
+
+	list := func(query string) []Session {
+		w := testRequest("GET", "/api/v1/session?"+query, nil)
+		assert.Equal(t, 200, w.Code)
+		var sessions []Session
+		_ = json.Unmarshal(w.Body.Bytes(), &sessions)
+		return sessions
+	}
+	sessions := list(fmt.Sprintf("since=%v", start))
+	assert.Equal(t, 1, len(sessions))
+	s := sessions[0]
+	assert.Equal(t, system.systemName, s.SystemName)
+	assert.Equal(t, 4242, s.ProcessId)
+	assert.Equal(t, start, s.ProcessStartTime)
+	assert.Equal(t, start+1000, s.FirstCommand)
+	assert.Equal(t, start+3000, s.LastCommand)
+	assert.Equal(t, "/home", s.FirstPath)
+	assert.Equal(t, "/srv/app", s.LastPath)
+	assert.Equal(t, 3, s.TotalCommands)
+	assert.Empty(t, s.Commands)
+	assert.Equal(t, 0, len(list(fmt.Sprintf("since=%v&systemName=other", start))))
+	assert.Equal(t, 0, len(list(fmt.Sprintf("until=%v&since=%v", start, start))))
+	assert.NotEqual(t, 0, len(list("limit=1")))
+
+	w := testRequest("GET", fmt.Sprintf("/api/v1/session/%v", s.ID), nil)
+	assert.Equal(t, 200, w.Code)
+	var replay Session
+	_ = json.Unmarshal(w.Body.Bytes(), &replay)
+	var commands []string
+	for _, q := range replay.Commands {
+		commands = append(commands, q.Command)
+	}
+	assert.Equal(t, []string{"cd /srv/app", "git pull", "make deploy"}, commands)
+	assert.Equal(t, "/home", replay.Commands[0].Path)
+
+	// the same sessions are made from existing commands
+	_, err := db.Exec(`DELETE FROM sessions`)
+	assert.Nil(t, err)
+	_, err = db.Exec(`DELETE FROM migrations`)
+	assert.Nil(t, err)
+	migrateOnce("sessions_backfill", sessionsBackfill)
+	sessions = list(fmt.Sprintf("since=%v", start))
+	assert.Equal(t, 1, len(sessions))
+	s.ID = sessions[0].ID
+	assert.Equal(t, s, sessions[0])
+
+	w = testRequest("GET", "/api/v1/session/999999", nil)
+	assert.Equal(t, 404, w.Code)
+	w = testRequest("GET", "/api/v1/session/latest", nil)
+	assert.Equal(t, 400, w.Code)
+}
+
+func TestStatusSessions(t *testing.T) {
+	// a user and system of their own, so the totals are exact
+	token := jwtToken
+	defer func() { jwtToken = token }()
+	w := testRequest("POST", "/api/v1/user", strings.NewReader(`{"Username": "status-sessions", "password": "status-sessions", "email": "status@example.com"}`))
+	assert.Equal(t, 200, w.Code)
+	login := func() {
+		w := testRequest("POST", "/api/v1/login", strings.NewReader(`{"username": "status-sessions", "password": "status-sessions", "mac": "777777777777777"}`))
+		assert.Equal(t, 200, w.Code)
+		j := make(map[string]interface{})
+		check(json.Unmarshal(w.Body.Bytes(), &j))
+		jwtToken = fmt.Sprintf("Bearer %v", j["accessToken"])
+	}
+	login()
+	w = testRequest("POST", "/api/v1/system", strings.NewReader(`{"clientVersion": "1.2.0", "name": "status-system", "hostname": "status-host", "mac": "777777777777777"}`))
+	assert.Equal(t, 201, w.Code)
+	login()
+
+	start := time.Now().Unix() * 1000
+	insert := func(processStartTime int64) string {
+		tc := Command{
+			Command:          "uptime",
+			Path:             "/srv/status",
+			Created:          time.Now().UnixNano() / int64(time.Millisecond),
+			ProcessId:        42,
+			ProcessStartTime: processStartTime,
+			Uuid:             uuid.New().String(),
+		}
+		payloadBytes, err := json.Marshal(&tc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := testRequest("POST", "/api/v1/command", bytes.NewReader(payloadBytes))
+		assert.Equal(t, 200, w.Code)
+		return tc.Uuid
+	}
+	insert(start)
+	insert(start)
+	// the same pid in a shell started later, as after a reboot
+	later := insert(start + 1)
+
+	status := func(startTime int64) Status {
+		w := testRequest("GET", fmt.Sprintf("/api/v1/client-view/status?processId=42&startTime=%v", startTime), nil)
+		assert.Equal(t, 200, w.Code)
+		var status Status
+		_ = json.Unmarshal(w.Body.Bytes(), &status)
+		return status
+	}
+	s := status(start)
+	assert.Equal(t, "status-system", s.SystemName)
+	assert.Equal(t, 2, s.SessionTotalCommands)
+	assert.Equal(t, 3, s.TotalCommands)
+	assert.Equal(t, 2, s.TotalSessions)
+	assert.Equal(t, 1, s.TotalSystems)
+	assert.Equal(t, 3, s.SystemTotalCommands)
+	assert.Equal(t, 2, s.SystemTotalSessions)
+	assert.Equal(t, 1, status(start+1).SessionTotalCommands)
+	assert.Equal(t, 0, status(start+2).SessionTotalCommands)
+
+	w = testRequest("DELETE", "/api/v1/command/"+later, nil)
+	assert.Equal(t, 200, w.Code)
+	s = status(start + 1)
+	assert.Equal(t, 0, s.SessionTotalCommands)
+	assert.Equal(t, 2, s.TotalCommands)
+	assert.Equal(t, 1, s.TotalSessions)
+	assert.Equal(t, 2, s.SystemTotalCommands)
+	assert.Equal(t, 1, s.SystemTotalSessions)
+}
+
+func TestCommandDuration(t *testing.T) {
+	created := time.Now().Unix() * 1000
+	run := func(command string, timing string) (int, string) {
+		id := uuid.New().String()
+		body := fmt.Sprintf(`{"command": %q, "path": %q, "created": %v, "uuid": %q, %v}`,
+			command, dir, created, id, timing)
+		w := testRequest("POST", "/api/v1/command", strings.NewReader(body))
+		return w.Code, id
+	}
+	code, build := run("duration make build", fmt.Sprintf(`"startTime": %v, "endTime": %v`, created, created+90000))
+	assert.Equal(t, 200, code)
+	code, _ = run("duration make build", `"durationMs": 30000`)
+	assert.Equal(t, 200, code)
+	code, deploy := run("duration make deploy", fmt.Sprintf(`"endTime": %v, "durationMs": 100000`, created+100000))
+	assert.Equal(t, 200, code)
+	code, quick := run("duration ls", `"durationMs": 5`)
+	assert.Equal(t, 200, code)
+	code, untimed := run("duration pwd", `"exitStatus": 0`)
+	assert.Equal(t, 200, code)
+	code, _ = run("duration bad", fmt.Sprintf(`"startTime": %v, "endTime": %v`, created, created-1))
+	assert.Equal(t, 400, code)
+	code, _ = run("duration bad", fmt.Sprintf(`"startTime": %v, "endTime": %v, "durationMs": 1`, created, created+90000))
+	assert.Equal(t, 400, code)
+
+	get := func(u string, v interface{}) {
+		w := testRequest("GET", u, nil)
+		assert.Equal(t, 200, w.Code, u)
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatal(u, err)
+		}
+	}
+	var one Query
+	get("/api/v1/command/"+build, &one)
+	assert.Equal(t, created, one.StartTime)
+	assert.Equal(t, created+90000, one.EndTime)
+	assert.Equal(t, int64(90000), one.Duration)
+	var derived Query
+	get("/api/v1/command/"+deploy, &derived)
+	assert.Equal(t, created, derived.StartTime)
+	assert.Equal(t, created+100000, derived.EndTime)
+	var untimedOne Query
+	get("/api/v1/command/"+untimed, &untimedOne)
+	assert.Zero(t, untimedOne.Duration)
+
+	var data []Query
+	get("/api/v1/command/search?verbose=true&minDuration=1m&query=^duration", &data)
+	assert.Equal(t, 2, len(data))
+	for _, q := range data {
+		assert.True(t, q.Duration >= 60000, q.Command)
+	}
+	get("/api/v1/command/search?unique=true&minDuration=1000&query=^duration", &data)
+	assert.Equal(t, 2, len(data))
+	get("/api/v1/command/search?mode=fuzzy&minDuration=1&query=duration", &data)
+	assert.Equal(t, 4, len(data))
+	w := testRequest("GET", "/api/v1/command/search?minDuration=long", nil)
+	assert.Equal(t, 400, w.Code)
+
+	var slowest []SlowCommand
+	get("/api/v1/command/slowest?query=^duration", &slowest)
+	assert.Equal(t, []SlowCommand{
+		{Command: "duration make build", Runs: 2, Total: 120000, Average: 60000, Longest: 90000},
+		{Command: "duration make deploy", Runs: 1, Total: 100000, Average: 100000, Longest: 100000},
+		{Command: "duration ls", Runs: 1, Total: 5, Average: 5, Longest: 5},
+	}, slowest)
+	get("/api/v1/command/slowest?by=longest&limit=1&query=^duration", &slowest)
+	assert.Equal(t, 1, len(slowest))
+	assert.Equal(t, "duration make deploy", slowest[0].Command)
+	get(fmt.Sprintf("/api/v1/command/slowest?since=%v&query=^duration", created+1), &slowest)
+	assert.Empty(t, slowest)
+	w = testRequest("GET", "/api/v1/command/slowest?by=slowest", nil)
+	assert.Equal(t, 400, w.Code)
+
+	w = testRequest("DELETE", "/api/v1/command/"+quick, nil)
+	assert.Equal(t, 200, w.Code)
 }
 
 func dirCleanup() {
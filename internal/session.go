@@ -0,0 +1,48 @@
+/*
+ *
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+// Session is a shell that commands were run in, identified by the process id
+// and start time of the shell on one of a user's systems.
+type Session struct {
+	ID               uint   `json:"id" gorm:"primary_key"`
+	UserId           uint   `json:"-"`
+	SystemName       string `json:"systemName"`
+	ProcessId        int    `json:"processId"`
+	ProcessStartTime int64  `json:"processStartTime"`
+	// FirstCommand and LastCommand are when the first and last commands were
+	// run, in FirstPath and LastPath.
+	FirstCommand  int64  `json:"firstCommand"`
+	LastCommand   int64  `json:"lastCommand"`
+	FirstPath     string `json:"firstPath"`
+	LastPath      string `json:"lastPath"`
+	TotalCommands int    `json:"totalCommands"`
+	// Commands are the session's commands in the order they were run.
+	Commands []Query `json:"commands,omitempty" gorm:"-"`
+}
+
+// SessionFilter selects a user's sessions. Zero values match everything.
+type SessionFilter struct {
+	UserId     uint
+	SystemName string
+	// Since and Until match sessions with commands in between them.
+	Since int64
+	Until int64
+	Limit int
+}
@@ -0,0 +1,194 @@
+/*
+ *
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/appleboy/gin-jwt/v2"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// streamBuffer is how many commands a stream subscriber can fall behind
+	// before newer ones are dropped.
+	streamBuffer = 64
+	// streamPing is how often an idle stream sends a comment to keep
+	// proxies from closing it.
+	streamPing = 30 * time.Second
+	// streamMaxPerUser is how many streams one user can have open at once.
+	streamMaxPerUser = 16
+)
+
+// commandHub sends each command inserted to its user's streams.
+var commandHub = newHub()
+
+// subscriber is a stream of one user's commands, optionally only those from
+// one system or path.
+type subscriber struct {
+	userID     uint
+	systemName string
+	path       string
+	commands   chan Query
+	// closed is closed to end the stream when the server shuts down.
+	closed chan struct{}
+
+	mu      sync.Mutex
+	dropped int
+}
+
+// hub holds the subscribers by user.
+type hub struct {
+	mu   sync.RWMutex
+	subs map[uint]map[*subscriber]struct{}
+}
+
+func newHub() *hub {
+	return &hub{subs: make(map[uint]map[*subscriber]struct{})}
+}
+
+// subscribe adds s unless its user already has streamMaxPerUser streams.
+func (h *hub) subscribe(s *subscriber) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	subs := h.subs[s.userID]
+	if len(subs) >= streamMaxPerUser {
+		return false
+	}
+	if subs == nil {
+		subs = make(map[*subscriber]struct{})
+		h.subs[s.userID] = subs
+	}
+	s.commands = make(chan Query, streamBuffer)
+	s.closed = make(chan struct{})
+	subs[s] = struct{}{}
+	streamSubscribers.Inc()
+	return true
+}
+
+func (h *hub) unsubscribe(s *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	subs := h.subs[s.userID]
+	if _, ok := subs[s]; ok {
+		delete(subs, s)
+		if len(subs) == 0 {
+			delete(h.subs, s.userID)
+		}
+		streamSubscribers.Dec()
+	}
+}
+
+// closeAll ends every stream, so they don't hold up a graceful shutdown.
+func (h *hub) closeAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for userID, subs := range h.subs {
+		for s := range subs {
+			close(s.closed)
+			streamSubscribers.Dec()
+		}
+		delete(h.subs, userID)
+	}
+}
+
+// publish sends q to userID's matching subscribers without blocking, it's
+// dropped for those whose buffers are full.
+func (h *hub) publish(userID uint, q Query) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for s := range h.subs[userID] {
+		if (s.systemName != "" && s.systemName != q.SystemName) ||
+			(s.path != "" && s.path != q.Path) {
+			continue
+		}
+		select {
+		case s.commands <- q:
+		default:
+			s.mu.Lock()
+			s.dropped++
+			s.mu.Unlock()
+			streamDropped.Inc()
+		}
+	}
+}
+
+// takeDropped returns how many commands were dropped since it was last called.
+func (s *subscriber) takeDropped() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.dropped
+	s.dropped = 0
+	return n
+}
+
+// commandStream sends the user's commands as server-sent events as they're
+// inserted, each as a command event. A dropped event with a count is sent
+// first when a slow client missed some. A user with streamMaxPerUser streams
+// open gets a 429.
+func commandStream(c *gin.Context) {
+	s := &subscriber{
+		systemName: c.Query("systemName"),
+		path:       c.Query("path"),
+	}
+	claims := jwt.ExtractClaims(c)
+	switch claims["user_id"].(type) {
+	case float64:
+		s.userID = uint(claims["user_id"].(float64))
+
+	default:
+		s.userID = claims["user_id"].(uint)
+	}
+	if !commandHub.subscribe(s) {
+		respondError(c, http.StatusTooManyRequests, errCodeRateLimited,
+			fmt.Errorf("at most %v streams can be open at once", streamMaxPerUser))
+		return
+	}
+	defer commandHub.unsubscribe(s)
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.SSEvent("ready", gin.H{})
+	c.Writer.Flush()
+
+	ping := time.NewTicker(streamPing)
+	defer ping.Stop()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case <-s.closed:
+			return false
+		case <-ping.C:
+			_, err := io.WriteString(w, ": ping\n\n")
+			return err == nil
+		case q := <-s.commands:
+			if n := s.takeDropped(); n > 0 {
+				c.SSEvent("dropped", gin.H{"count": n})
+			}
+			c.SSEvent("command", q)
+			return true
+		}
+	})
+}
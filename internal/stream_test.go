@@ -0,0 +1,70 @@
+/*
+ *
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHub(t *testing.T) {
+	h := newHub()
+	all := &subscriber{userID: 1}
+	sys := &subscriber{userID: 1, systemName: "ci"}
+	other := &subscriber{userID: 2}
+	for _, s := range []*subscriber{all, sys, other} {
+		assert.True(t, h.subscribe(s))
+	}
+
+	h.publish(1, Query{Command: "make", SystemName: "laptop"})
+	h.publish(1, Query{Command: "make test", SystemName: "ci"})
+	assert.Equal(t, 2, len(all.commands))
+	assert.Equal(t, 1, len(sys.commands))
+	assert.Equal(t, "make test", (<-sys.commands).Command)
+	assert.Equal(t, 0, len(other.commands))
+
+	// a subscriber that falls behind misses commands rather than blocking
+	for i := 0; i < streamBuffer; i++ {
+		h.publish(1, Query{Command: "ls"})
+	}
+	assert.Equal(t, streamBuffer, len(all.commands))
+	assert.Equal(t, 2, all.takeDropped())
+	assert.Equal(t, 0, all.takeDropped())
+
+	// a user can only have so many streams
+	var extra []*subscriber
+	for i := 0; i < streamMaxPerUser-1; i++ {
+		extra = append(extra, &subscriber{userID: 2})
+		assert.True(t, h.subscribe(extra[i]))
+	}
+	assert.False(t, h.subscribe(&subscriber{userID: 2}))
+	assert.True(t, h.subscribe(&subscriber{userID: 3}))
+	h.unsubscribe(extra[0])
+	assert.True(t, h.subscribe(&subscriber{userID: 2}))
+
+	h.unsubscribe(other)
+	h.closeAll()
+	_, open := <-all.closed
+	assert.False(t, open)
+	_, open = <-sys.closed
+	assert.False(t, open)
+	h.unsubscribe(all)
+	assert.Empty(t, h.subs)
+}
@@ -0,0 +1,166 @@
+/*
+ *
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// certReloader serves a certificate and key pair that is reloaded from disk on
+// SIGHUP or when either file changes, so renewed certificates are picked up
+// without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+
+	stopOnce sync.Once
+	stopped  chan struct{}
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile, stopped: make(chan struct{})}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// lastModified returns the most recent modification time of the pair.
+func (cr *certReloader) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{cr.certFile, cr.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (cr *certReloader) reload() error {
+	modTime, err := cr.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.cert = &cert
+	cr.modTime = modTime
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// changed reports whether the files were modified since they were last loaded.
+func (cr *certReloader) changed() bool {
+	modTime, err := cr.lastModified()
+	if err != nil {
+		return false
+	}
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return modTime.After(cr.modTime)
+}
+
+// watch reloads the certificate on SIGHUP and when the files change until stop
+// is called. A failed reload keeps serving the previous certificate.
+func (cr *certReloader) watch(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cr.stopped:
+			return
+		case <-hup:
+		case <-ticker.C:
+			if !cr.changed() {
+				continue
+			}
+		}
+		if err := cr.reload(); err != nil {
+			logger.WithError(err).Error("tls: keeping current certificate, reload failed")
+			continue
+		}
+		logger.WithField("file", cr.certFile).Info("tls: reloaded certificate")
+	}
+}
+
+// stop ends watch. It's safe to call more than once.
+func (cr *certReloader) stop() {
+	cr.stopOnce.Do(func() { close(cr.stopped) })
+}
+
+// tlsConfig builds the server tls config from opts. Client certificates are
+// requested and verified against TLSClientCA when it is set. The certificate
+// is watched for changes until the returned stop func is called.
+func tlsConfig(opts Options) (*tls.Config, func(), error) {
+	if opts.TLSCert == "" || opts.TLSKey == "" {
+		return nil, nil, errors.New("tls: both --tls-cert and --tls-key are required")
+	}
+	cr, err := newCertReloader(opts.TLSCert, opts.TLSKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conf := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cr.GetCertificate,
+	}
+	if opts.TLSClientCA != "" {
+		pem, err := ioutil.ReadFile(opts.TLSClientCA)
+		if err != nil {
+			return nil, nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, errors.New("tls: no certificates found in " + opts.TLSClientCA)
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	go cr.watch(10 * time.Second)
+	return conf, cr.stop, nil
+}
@@ -0,0 +1,174 @@
+/*
+ *
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert creates a certificate for cn signed by parent, or a self signed
+// CA when parent is nil.
+func newTestCert(cn string, serial int64, parent *testCert) testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	check(err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	check(err)
+	cert, err := x509.ParseCertificate(der)
+	check(err)
+	return testCert{cert: cert, key: key}
+}
+
+func (c testCert) write(certFile string, keyFile string) {
+	err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0600)
+	check(err)
+	if keyFile == "" {
+		return
+	}
+	b, err := x509.MarshalECPrivateKey(c.key)
+	check(err)
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}), 0600)
+	check(err)
+}
+
+func (c testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+func TestCertReloader(t *testing.T) {
+	certFile := filepath.Join(testDir, "reload.crt")
+	keyFile := filepath.Join(testDir, "reload.key")
+	ca := newTestCert("bashhub test ca", 1, nil)
+	newTestCert("localhost", 2, &ca).write(certFile, keyFile)
+
+	cr, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, cr.changed())
+
+	newTestCert("localhost", 3, &ca).write(certFile, keyFile)
+	future := time.Now().Add(time.Minute)
+	check(os.Chtimes(certFile, future, future))
+	assert.True(t, cr.changed())
+	check(cr.reload())
+
+	cert, err := cr.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(3), leaf.SerialNumber.Int64())
+
+	done := make(chan struct{})
+	go func() {
+		cr.watch(time.Hour)
+		close(done)
+	}()
+	cr.stop()
+	cr.stop()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch didn't stop")
+	}
+}
+
+func TestClientCertAuth(t *testing.T) {
+	ca := newTestCert("bashhub test ca", 1, nil)
+	opts := Options{
+		TLSCert:     filepath.Join(testDir, "server.crt"),
+		TLSKey:      filepath.Join(testDir, "server.key"),
+		TLSClientCA: filepath.Join(testDir, "ca.crt"),
+	}
+	ca.write(opts.TLSClientCA, "")
+	newTestCert("localhost", 2, &ca).write(opts.TLSCert, opts.TLSKey)
+	conf, stop, err := tlsConfig(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: router}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(cn string) int {
+		clientConf := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+		if cn != "" {
+			clientConf.Certificates = []tls.Certificate{newTestCert(cn, 4, &ca).tlsCertificate()}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConf}}
+		resp, err := client.Get("https://" + ln.Addr().String() + "/api/v1/command/search?limit=1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, 200, get(system.user))
+	assert.Equal(t, 401, get("nobody"))
+	assert.Equal(t, 401, get(""))
+}
@@ -0,0 +1,271 @@
+/*
+ *
+ * Copyright © 2020 nicksherron <nsherron90@gmail.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/appleboy/gin-jwt/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// wsBatchSize is how many results are sent per message.
+	wsBatchSize = 50
+	// wsMaxMessage is the largest search message read from a client.
+	wsMaxMessage = 4096
+	// wsWriteWait is how long a client has to take a message.
+	wsWriteWait = 10 * time.Second
+	// wsPongWait is how long a client has to answer a ping.
+	wsPongWait = 2 * streamPing
+)
+
+// The default origin check turns away browsers on other sites, which would
+// otherwise be let in by the jwt cookie.
+var upgrader = websocket.Upgrader{}
+
+// searchSockets are the open search websockets. Once upgraded they're
+// hijacked from the http server, which neither waits for nor closes them on
+// shutdown.
+var searchSockets = &socketSet{conns: make(map[*websocket.Conn]struct{})}
+
+type socketSet struct {
+	mu    sync.Mutex
+	conns map[*websocket.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+func (s *socketSet) add(conn *websocket.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+}
+
+// remove forgets conn once its handler is done with it.
+func (s *socketSet) remove(conn *websocket.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+	s.wg.Done()
+}
+
+// closeAll tells every client the server is going away and closes their
+// connections, which ends their handlers and cancels their searches.
+func (s *socketSet) closeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	for conn := range s.conns {
+		_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteWait))
+		conn.Close()
+	}
+}
+
+// wait blocks until every handler has finished.
+func (s *socketSet) wait() {
+	s.wg.Wait()
+}
+
+// searchMessage is a search sent over a websocket. It takes the search
+// endpoint's parameters and replaces the client's previous search.
+type searchMessage struct {
+	ID                int              `json:"id"`
+	Query             string           `json:"query"`
+	Limit             int              `json:"limit"`
+	Unique            bool             `json:"unique"`
+	Path              string           `json:"path"`
+	SystemName        string           `json:"systemName"`
+	MinDuration       jsonMilliseconds `json:"minDuration"`
+	Mode              string           `json:"mode"`
+	Sort              string           `json:"sort"`
+	ContextPath       string           `json:"contextPath"`
+	ContextSystemName string           `json:"contextSystemName"`
+	Verbose           bool             `json:"verbose"`
+}
+
+// searchReply is a batch of a search's results, the last one has Done set.
+// A failed search gets a single reply with the error. Truncated is set like
+// the search endpoint's X-Fuzzy-Truncated header.
+type searchReply struct {
+	ID        int     `json:"id"`
+	Results   []Query `json:"results"`
+	Done      bool    `json:"done"`
+	Truncated bool    `json:"truncated,omitempty"`
+	Error     string  `json:"error,omitempty"`
+	ErrorCode string  `json:"errorCode,omitempty"`
+}
+
+// searchSocket serves searches as you type over a websocket. Each search
+// message cancels the one before it and counts against l like a search
+// request.
+func searchSocket(opts Options, l *limiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var command Command
+		claims := jwt.ExtractClaims(c)
+		switch claims["user_id"].(type) {
+		case float64:
+			command.User.ID = uint(claims["user_id"].(float64))
+
+		default:
+			command.User.ID = claims["user_id"].(uint)
+		}
+		username, _ := claims["username"].(string)
+
+		conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			// the upgrader has responded
+			return
+		}
+		defer conn.Close()
+		searchSockets.add(conn)
+		defer searchSockets.remove(conn)
+
+		var mu sync.Mutex
+		write := func(reply searchReply) error {
+			mu.Lock()
+			defer mu.Unlock()
+			_ = conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			return conn.WriteJSON(reply)
+		}
+
+		var searches sync.WaitGroup
+		defer searches.Wait()
+		ctx, closed := context.WithCancel(c.Request.Context())
+		defer closed()
+		go func() {
+			ping := time.NewTicker(streamPing)
+			defer ping.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ping.C:
+					if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+						return
+					}
+				}
+			}
+		}()
+
+		conn.SetReadLimit(wsMaxMessage)
+		_ = conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		})
+		cancel := func() {}
+		defer func() { cancel() }()
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			_ = conn.SetReadDeadline(time.Now().Add(wsPongWait))
+			cancel()
+
+			var msg searchMessage
+			if err := json.Unmarshal(data, &msg); err != nil {
+				_ = write(searchReply{Done: true, Error: err.Error(), ErrorCode: errCodeBadRequest})
+				continue
+			}
+			if l != nil {
+				if _, err := l.takeFor(c); err != nil {
+					_ = write(searchReply{ID: msg.ID, Done: true, Error: err.Error(), ErrorCode: errCodeRateLimited})
+					continue
+				}
+			}
+			cmd := command
+			cmd.Query, cmd.Limit, cmd.Unique = msg.Query, msg.Limit, msg.Unique
+			cmd.Path, cmd.SystemName, cmd.MinDuration = msg.Path, msg.SystemName, int64(msg.MinDuration)
+			if cmd.Limit <= 0 {
+				cmd.Limit = 100
+			}
+			params := searchParams{
+				Mode:     msg.Mode,
+				Sort:     msg.Sort,
+				Here:     frecencyContext{Path: msg.ContextPath, SystemName: msg.ContextSystemName},
+				Verbose:  msg.Verbose,
+				Username: username,
+			}
+			if params.Mode == "" {
+				params.Mode = "regex"
+			}
+			if params.Sort == "" {
+				params.Sort = "created"
+			}
+			if status, code, err := params.validate(cmd); status != 0 {
+				_ = write(searchReply{ID: msg.ID, Done: true, Error: err.Error(), ErrorCode: code})
+				continue
+			}
+
+			search, stop := context.WithCancel(ctx)
+			cancel = stop
+			searches.Add(1)
+			go func(ctx context.Context, id int) {
+				defer searches.Done()
+				if opts.SearchTimeout > 0 {
+					var cancel context.CancelFunc
+					ctx, cancel = context.WithTimeout(ctx, opts.SearchTimeout)
+					defer cancel()
+				}
+				result, truncated, err := cmd.search(ctx, params)
+				if ctx.Err() == context.Canceled {
+					// replaced by the next search or the client's gone
+					return
+				}
+				if err != nil {
+					reply := searchReply{ID: id, Done: true}
+					status, code := dbErrorStatus(err)
+					switch {
+					case ctx.Err() == context.DeadlineExceeded:
+						reply.Error, reply.ErrorCode = searchTimedOut(opts.SearchTimeout).Error(), errCodeSearchTimeout
+					case status >= 500:
+						ctxLog(ctx).WithError(err).Error("websocket search failed")
+						reply.Error, reply.ErrorCode = http.StatusText(status), code
+					default:
+						reply.Error, reply.ErrorCode = err.Error(), code
+					}
+					_ = write(reply)
+					return
+				}
+				for start := 0; start == 0 || start < len(result); start += wsBatchSize {
+					end := start + wsBatchSize
+					if end > len(result) {
+						end = len(result)
+					}
+					if ctx.Err() != nil {
+						return
+					}
+					reply := searchReply{ID: id, Results: result[start:end], Done: end == len(result), Truncated: truncated}
+					if reply.Results == nil {
+						reply.Results = []Query{}
+					}
+					if err := write(reply); err != nil {
+						return
+					}
+				}
+			}(search, msg.ID)
+		}
+	}
+}
@@ -43,6 +43,7 @@ xgo \
     -out="bashhub-server-${version}" \
     --targets="linux/arm64,linux/arm-7,linux/amd64,linux/386,darwin/amd64,windows/*" \
     --dest=dist \
+    -tags sqlite_fts5 \
     -ldflags "-X github.com/nicksherron/bashhub-server/cmd.Version=${version}
      -X github.com/nicksherron/bashhub-server/cmd.GitCommit=${commit}
      -X github.com/nicksherron/bashhub-server/cmd.BuildDate=${build_date}" \